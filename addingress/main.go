@@ -1,15 +1,100 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
+	informercorev1 "k8s.io/client-go/informers/core/v1"
+	informernetv1 "k8s.io/client-go/informers/networking/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"log"
+	"net/http"
+	"os"
 	"share-code-operator-study/addingress/pkg"
+	"share-code-operator-study/addingress/pkg/signals"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	// 同一个namespace中声明了相同host的service，是否共用一个ingress
+	aggregateByHost bool
+	// service 没有指定路由后端时使用的后端
+	routeBackend string
+	// httproute 后端挂载的 Gateway
+	gateway string
+	// 监听的namespace，逗号分隔，为空时监听整个集群
+	namespaces string
+	// service 的 label selector，只处理匹配的service
+	serviceSelector string
+	// 是否开启选主，运行多个副本时需要开启
+	leaderElect bool
+	// 选主使用的 Lease 所在的namespace
+	leaderElectNamespace string
+	// 选主使用的 Lease 的名称
+	leaderElectID string
+	// 监控指标和健康检查的监听地址，为空时不启动
+	metricsAddr string
+	// 与service同名的ingress已存在、但不是由service控制时的处理方式
+	adoptPolicy string
+	// 强制接管ingress上被其它 field manager 修改过的字段
+	forceConflicts bool
+	// 只记录计划中的修改，不写入路由对象
+	dryRun bool
+	// dry-run 模式下，缓存同步完成后输出一次计划中的修改并退出
+	report bool
+	// service 没有设置 ingress/host 时，生成 host 的模板
+	hostTemplate string
+	// service 上以这个前缀开头的annotation，去掉前缀后复制到ingress上
+	annotationPrefix string
+	// validating admission webhook 的监听地址，为空时不启动
+	webhookAddr string
+	// webhook 使用的证书和私钥
+	webhookCertFile string
+	webhookKeyFile  string
+	// 全局默认值 ConfigMap 所在的namespace，为空时没有全局的默认值。默认为空，避免有人在某个namespace中创建了这个 ConfigMap 就影响所有service
+	defaultsNamespace string
 )
 
 func main() {
+	flag.Parse()
+
+	if routeBackend != "ingress" && routeBackend != "httproute" {
+		log.Fatalf("unknown --route-backend %q", routeBackend)
+	}
+	if routeBackend == "httproute" && gateway == "" {
+		log.Fatalln("--route-backend=httproute requires --gateway")
+	}
+	if !contains(pkg.AdoptPolicies, adoptPolicy) {
+		log.Fatalf("unknown --adopt-policy %q, must be one of %s", adoptPolicy, strings.Join(pkg.AdoptPolicies, ", "))
+	}
+	if _, err := labels.Parse(serviceSelector); err != nil {
+		log.Fatalf("invalid --selector %q: %v", serviceSelector, err)
+	}
+
+	var tmpl *template.Template
+	if hostTemplate != "" {
+		var err error
+		if tmpl, err = pkg.ParseHostTemplate(hostTemplate); err != nil {
+			log.Fatalf("invalid --host-template %q: %v", hostTemplate, err)
+		}
+	}
+
 	// 创建一个 集群客户端配置
 	config, err := clientcmd.BuildConfigFromFlags("", clientcmd.RecommendedHomeFile)
 	if err != nil {
@@ -26,23 +111,306 @@ func main() {
 		panic(err.Error())
 	}
 
-	// 创建一个 informerFactory
-	factory := informers.NewSharedInformerFactory(clientset, 0)
-	// 使用 informerFactory 创建Services资源的 informer对象
-	serviceInformer := factory.Core().V1().Services()
-	// 使用 informerFactory 创建Ingresses资源的 informer对象
-	ingressInformer := factory.Networking().V1().Ingresses()
+	// 每个监听的namespace创建一个 informerFactory，只缓存这个namespace中的对象；没有指定namespace时，只创建一个监听整个集群的 informerFactory
+	watchNamespaces := splitNamespaces(namespaces)
+	var factories []informers.SharedInformerFactory
+	var serviceInformers []informercorev1.ServiceInformer
+	var ingressInformers []informernetv1.IngressInformer
+	var configMapInformers []informercorev1.ConfigMapInformer
+	for _, namespace := range watchNamespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+		factories = append(factories, factory)
+		// 使用 informerFactory 创建Services资源的 informer对象，只缓存匹配 selector 的service
+		serviceInformers = append(serviceInformers, serviceInformerFor(factory, namespace, serviceSelector))
+		// 使用 informerFactory 创建Ingresses资源的 informer对象
+		ingressInformers = append(ingressInformers, factory.Networking().V1().Ingresses())
+		// 只缓存默认值 ConfigMap
+		configMapInformers = append(configMapInformers, configMapInformerFor(factory, namespace))
+	}
+	// 全局默认值 ConfigMap 所在的namespace不在监听范围内时，单独为它创建一个 informerFactory
+	if defaultsNamespace != "" && !contains(watchNamespaces, metav1.NamespaceAll) && !contains(watchNamespaces, defaultsNamespace) {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(defaultsNamespace))
+		factories = append(factories, factory)
+		configMapInformers = append(configMapInformers, configMapInformerFor(factory, defaultsNamespace))
+	}
 
 	// 创建一个自定义控制器
-	controller := pkg.NewController(clientset, serviceInformer, ingressInformer)
+	controller := pkg.NewController(clientset, serviceInformers, ingressInformers, pkg.Options{
+		AggregateByHost:  aggregateByHost,
+		RouteBackend:     routeBackend,
+		AdoptPolicy:      adoptPolicy,
+		ForceConflicts:   forceConflicts,
+		DryRun:           dryRun || report,
+		HostTemplate:     tmpl,
+		AnnotationPrefix: annotationPrefix,
+	})
+
+	// 启用默认值 ConfigMap
+	controller.EnableDefaults(configMapInformers, defaultsNamespace)
+
+	// 收到 SIGTERM、SIGINT，或者 webhook、metrics 的 http server 出错时关闭 stopCh，按同样的流程处理完已经取出的key、释放 lease 后退出。
+	// 第二次收到信号时直接退出
+	serverErrCh := make(chan error, 2)
+	stopCh, stopErrCh := stopOnError(signals.SetupSignalHandler(), serverErrCh)
+
+	// 指定了 Gateway 时，启用 httproute 后端。HTTPRoute 没有 Go 类型，使用 dynamic client 和 dynamic informer
+	var dynamicFactories []dynamicinformer.DynamicSharedInformerFactory
+	if gateway != "" {
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			panic(err.Error())
+		}
+		var routeInformers []informers.GenericInformer
+		for _, namespace := range watchNamespaces {
+			dynamicFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, namespace, nil)
+			dynamicFactories = append(dynamicFactories, dynamicFactory)
+			routeInformers = append(routeInformers, dynamicFactory.ForResource(pkg.HTTPRouteResource))
+		}
+		if err := controller.EnableHTTPRoute(dynamicClient, routeInformers, gateway); err != nil {
+			log.Fatalf("invalid --gateway %q: %v", gateway, err)
+		}
+	}
+
+	// 启动监控指标和健康检查的 http server
+	if metricsAddr != "" && !report {
+		go func() {
+			if err := serveMetrics(metricsAddr, controller.HasSynced, stopCh); err != nil {
+				serverErrCh <- fmt.Errorf("metrics server: %v", err)
+			}
+		}()
+	}
+
+	// 启动 validating admission webhook。webhook 依赖informer的缓存，所有副本都会提供服务
+	if webhookAddr != "" && !report {
+		go func() {
+			if err := controller.ServeWebhook(webhookAddr, webhookCertFile, webhookKeyFile, stopCh); err != nil {
+				serverErrCh <- fmt.Errorf("webhook server: %v", err)
+			}
+		}()
+	}
+
+	// 在选主之前启动informer，未成为 leader 的副本也保持缓存同步，/readyz 可以反映缓存状态，成为 leader 后可以立即开始处理
+	for _, dynamicFactory := range dynamicFactories {
+		dynamicFactory.Start(stopCh)
+	}
+	for _, factory := range factories {
+		// 启动 informerFactory，会启动已经创建的 serviceInformer、ingressInformer
+		factory.Start(stopCh)
+	}
+
+	// 输出一次计划中的修改后退出，不需要选主
+	if report {
+		if !cache.WaitForCacheSync(stopCh, controller.HasSynced) {
+			log.Fatalln("failed to wait for caches to sync")
+		}
+		if err := controller.Report(os.Stdout); err != nil {
+			log.Fatalf("report: %v", err)
+		}
+		return
+	}
+
+	// run 等待informer同步后运行控制器，直到 stopCh 关闭、控制器处理完已经取出的key后返回
+	run := func(stopCh <-chan struct{}) {
+		// 等待 所有informer 从 etcd 实现全量同步
+		if !cache.WaitForCacheSync(stopCh, controller.HasSynced) {
+			return
+		}
+		// 启动自定义控制器
+		controller.Run(stopCh)
+	}
+
+	if leaderElect {
+		runWithLeaderElection(clientset, stopCh, run)
+	} else {
+		run(stopCh)
+	}
+	// 因为 http server 出错而退出时，返回非零的状态码
+	if err := <-stopErrCh; err != nil {
+		log.Fatalln(err)
+	}
+}
 
-	// 创建 停止channel信号
+// stopOnError 返回的 stopCh 在 signalCh 关闭，或者 errCh 收到错误时关闭。
+// stopCh 关闭后，返回的 error channel 中是导致退出的错误，收到退出信号时为 nil
+func stopOnError(signalCh <-chan struct{}, errCh <-chan error) (<-chan struct{}, <-chan error) {
 	stopCh := make(chan struct{})
-	// 启动 informerFactory，会启动已经创建的 serviceInformer、ingressInformer
-	factory.Start(stopCh)
-	// 等待 所有informer 从 etcd 实现全量同步
-	factory.WaitForCacheSync(stopCh)
+	stopErrCh := make(chan error, 1)
+	go func() {
+		var err error
+		select {
+		case <-signalCh:
+		case err = <-errCh:
+			log.Printf("%v, shutting down", err)
+		}
+		close(stopCh)
+		stopErrCh <- err
+	}()
+	return stopCh, stopErrCh
+}
+
+// serveMetrics 提供 /metrics、/healthz、/readyz 三个接口，stopCh 关闭后停止。
+// /healthz 只要进程在运行就返回 ok；/readyz 在所有informer完成同步后才返回 ok
+func serveMetrics(addr string, hasSynced cache.InformerSynced, stopCh <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !hasSynced() {
+			http.Error(w, "informer caches not synced", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-stopCh
+		server.Shutdown(context.Background())
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// runWithLeaderElection 通过 Lease 锁选主，只有 leader 才会运行控制器，多个副本不会同时处理同一个service
+func runWithLeaderElection(clientset kubernetes.Interface, stopCh <-chan struct{}, run func(stopCh <-chan struct{})) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("can't get hostname: %v", err)
+	}
+	// 同一个节点上可能运行多个副本，identity 加上随机的后缀
+	identity := hostname + "_" + string(uuid.NewUUID())
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaderElectID,
+			Namespace: leaderElectNamespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	// 选主使用单独的ctx：收到退出信号后，要等控制器处理完已经取出的key，再释放 lease，避免与新的 leader 同时处理
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go func() {
+		<-stopCh
+		select {
+		case <-started:
+			// 已经是 leader，控制器退出后由 OnStartedLeading 释放 lease
+		default:
+			// 还没有成为 leader，直接停止选主
+			cancel()
+		}
+	}()
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				close(started)
+				defer cancel()
+				log.Printf("%s became leader", identity)
+				// 收到退出信号，或者失去 leader 身份时，停止控制器
+				runStopCh := make(chan struct{})
+				go func() {
+					select {
+					case <-stopCh:
+					case <-leaderCtx.Done():
+					}
+					close(runStopCh)
+				}()
+				run(runStopCh)
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+					log.Printf("%s released leader lease", identity)
+				default:
+					// 没有收到退出信号却失去了 leader 身份，直接退出，由 Deployment 重启后重新参与选主
+					log.Fatalf("%s lost leader lease", identity)
+				}
+			},
+		},
+	})
+}
+
+// splitNamespaces 解析 --namespaces 参数，为空时返回 [""]，表示监听整个集群
+func splitNamespaces(value string) []string {
+	var result []string
+	for _, namespace := range strings.Split(value, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			result = append(result, namespace)
+		}
+	}
+	if len(result) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return result
+}
+
+// contains 判断 values 中是否包含 value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceInformerFor 在 factory 中注册一个按 label selector 过滤的 service informer。
+// factory 按对象类型缓存 informer，注册之后 factory.Core().V1().Services() 返回的就是这个过滤后的 informer
+func serviceInformerFor(factory informers.SharedInformerFactory, namespace, selector string) informercorev1.ServiceInformer {
+	factory.InformerFor(&corev1.Service{}, func(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		return informercorev1.NewFilteredServiceInformer(client, namespace, resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+			func(options *metav1.ListOptions) {
+				options.LabelSelector = selector
+			})
+	})
+	return factory.Core().V1().Services()
+}
+
+// configMapInformerFor 在 factory 中注册一个只缓存默认值 ConfigMap 的 informer
+func configMapInformerFor(factory informers.SharedInformerFactory, namespace string) informercorev1.ConfigMapInformer {
+	factory.InformerFor(&corev1.ConfigMap{}, func(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		return informercorev1.NewFilteredConfigMapInformer(client, namespace, resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+			func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", pkg.DefaultsConfigMapName).String()
+			})
+	})
+	return factory.Core().V1().ConfigMaps()
+}
 
-	// 启动自定义控制器
-	controller.Run(stopCh)
+func init() {
+	flag.BoolVar(&aggregateByHost, "aggregate-by-host", false, "Merge Services in a namespace that declare the same host into one shared Ingress, one path per Service.")
+	flag.StringVar(&routeBackend, "route-backend", "ingress", "Route object generated for Services that do not set the ingress/backend annotation: ingress or httproute.")
+	flag.StringVar(&gateway, "gateway", "", "Gateway (namespace/name) that generated HTTPRoutes attach to. Enables the httproute backend.")
+	flag.StringVar(&namespaces, "namespaces", "", "Comma-separated namespaces to watch. Watches the whole cluster if empty.")
+	flag.StringVar(&serviceSelector, "selector", "", "Label selector limiting the Services the controller handles, e.g. team=web.")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Elect a leader through a Lease before running the controller. Required when running more than one replica.")
+	flag.StringVar(&leaderElectNamespace, "leader-elect-namespace", "default", "Namespace of the Lease used for leader election.")
+	flag.StringVar(&leaderElectID, "leader-elect-id", "addingress-controller", "Name of the Lease used for leader election.")
+	flag.StringVar(&adoptPolicy, "adopt-policy", "ignore", "What to do when an Ingress or HTTPRoute named after a Service exists but is not controlled by it: ignore (Warning event), adopt (add controller reference) or rename (create <service>-<uid prefix>).")
+	flag.BoolVar(&forceConflicts, "force-conflicts", false, "Take over Ingress fields the controller sets when another field manager has changed them. By default the controller leaves them alone and records a FieldConflict Warning event on the Service. Adopting an Ingress with --adopt-policy=adopt always takes its fields over.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log a diff of the Ingresses and HTTPRoutes the controller would create, update or delete instead of writing them.")
+	flag.BoolVar(&report, "report", false, "Implies --dry-run. Print the planned changes for every Service once the caches have synced, then exit.")
+	flag.StringVar(&hostTemplate, "host-template", "", "Go text/template for the host of Services without the ingress/host annotation, e.g. {{.Name}}.{{.Namespace}}.apps.corp.internal. Fields: .Name, .Namespace, .Labels, .Annotations. Wrap lookups in required, e.g. {{required (index .Labels \"team\")}}, to fail instead of rendering an empty string when the label is missing. Not used for Services whose namespace has a host-suffix default in the "+pkg.DefaultsConfigMapName+" ConfigMap.")
+	flag.StringVar(&annotationPrefix, "annotation-prefix", "ingress.addingress.io/", "Service annotations with this prefix are copied to the generated Ingress with the prefix stripped. Disabled if empty.")
+	flag.StringVar(&webhookAddr, "webhook-addr", "", "Address serving the HTTPS validating admission webhook for Services at "+pkg.WebhookPath+". Disabled if empty.")
+	flag.StringVar(&webhookCertFile, "webhook-cert-file", "/tmp/k8s-webhook-server/serving-certs/tls.crt", "TLS certificate of the admission webhook.")
+	flag.StringVar(&webhookKeyFile, "webhook-key-file", "/tmp/k8s-webhook-server/serving-certs/tls.key", "TLS private key of the admission webhook.")
+	flag.StringVar(&defaultsNamespace, "defaults-namespace", "", "Namespace of the "+pkg.DefaultsConfigMapName+" ConfigMap that supplies defaults for all Services, e.g. addingress-system. Namespaces can override it with their own. Disabled if empty, the default: only the "+pkg.DefaultsConfigMapName+" ConfigMap in a Service's own namespace applies.")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "Address serving /metrics, /healthz and /readyz. Disabled if empty.")
 }
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strings"
+)
+
+// 控制器写回 service 的 annotation，记录 ingress 的访问地址。
+// ingress 的 status.loadBalancer.ingress 为空时（ingress controller 还没有分配地址），不设置这两个 annotation
+const (
+	// annoURL 访问service的 URL，包括 scheme、host 和 path，比如 https://example.com/
+	annoURL = "ingress/url"
+	// annoLoadBalancer ingress 负载均衡的 IP 或域名，多个地址以逗号分隔
+	annoLoadBalancer = "ingress/load-balancer"
+)
+
+// updateServiceAddress 将ingress的负载均衡地址写回service的annotation。
+// ingress 或 opts 为 nil 时，删除service上的地址annotation
+func (c *controller) updateServiceAddress(service *corev1.Service, ingress *netv1.Ingress, opts *ingressOptions) error {
+	desired := map[string]string{}
+	if ingress != nil && opts != nil {
+		var addresses []string
+		for _, lb := range ingress.Status.LoadBalancer.Ingress {
+			if lb.IP != "" {
+				addresses = append(addresses, lb.IP)
+			} else if lb.Hostname != "" {
+				addresses = append(addresses, lb.Hostname)
+			}
+		}
+		if len(addresses) != 0 {
+			scheme := "http"
+			if opts.tls {
+				scheme = "https"
+			}
+			desired[annoURL] = scheme + "://" + opts.host + opts.paths[0].path
+			desired[annoLoadBalancer] = strings.Join(addresses, ",")
+		}
+	}
+
+	return c.patchServiceAnnotations(service, []string{annoURL, annoLoadBalancer}, desired)
+}
+
+// clearServiceAnnotations 删除控制器写回service的所有annotation
+func (c *controller) clearServiceAnnotations(service *corev1.Service) error {
+	return c.patchServiceAnnotations(service, []string{annoURL, annoLoadBalancer, annoConflict}, nil)
+}
+
+// patchServiceAnnotations 将service上 keys 中的annotation修改为 desired 中的值，desired 中没有的key会被删除。
+// 控制器只修改自己写入的annotation，使用 merge patch 避免与其它对service的修改冲突
+func (c *controller) patchServiceAnnotations(service *corev1.Service, keys []string, desired map[string]string) error {
+	// 只修改与期望不一致的annotation，值为 nil 时 merge patch 会删除这个annotation
+	changes := map[string]interface{}{}
+	for _, key := range keys {
+		value, ok := desired[key]
+		current, exists := service.Annotations[key]
+		switch {
+		case ok && (!exists || current != value):
+			changes[key] = value
+		case !ok && exists:
+			changes[key] = nil
+		}
+	}
+	// dry-run 模式下不修改service
+	if len(changes) == 0 || c.dryRun != nil {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": changes,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.CoreV1().Services(service.Namespace).Patch(context.TODO(), service.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
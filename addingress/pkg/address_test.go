@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestUpdateServiceAddress(t *testing.T) {
+	// 客户端指向一个不存在的 apiserver，只有需要修改service时才会返回错误
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating client: %v", err)
+	}
+	c := newQueueController()
+	c.client = client
+
+	ingress := &netv1.Ingress{Status: netv1.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{
+		Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}, {Hostname: "lb.example.com"}},
+	}}}
+	opts := &ingressOptions{host: "app.example.com", paths: []backendPath{{path: "/api"}}, tls: true}
+	current := map[string]string{
+		annoURL:          "https://app.example.com/api",
+		annoLoadBalancer: "10.0.0.1,lb.example.com",
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ingress     *netv1.Ingress
+		patched     bool
+	}{
+		{name: "up to date", annotations: current, ingress: ingress},
+		{name: "no address yet", annotations: nil, ingress: &netv1.Ingress{}},
+		{name: "ingress deleted", annotations: nil, ingress: nil},
+		{name: "address changed", annotations: map[string]string{annoURL: current[annoURL], annoLoadBalancer: "10.0.0.2"}, ingress: ingress, patched: true},
+		{name: "stale address", annotations: current, ingress: nil, patched: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := annotatedService(test.annotations)
+			err := c.updateServiceAddress(service, test.ingress, opts)
+			if patched := err != nil; patched != test.patched {
+				t.Errorf("Expected patch %v, got error %v", test.patched, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 与service同名的ingress或HTTPRoute已经存在、但不是由service控制时的处理方式，由 --adopt-policy 参数设置
+const (
+	// adoptPolicyIgnore 不处理已存在的ingress，在service上记录Warning事件
+	adoptPolicyIgnore = "ignore"
+	// adoptPolicyAdopt 为已存在的ingress添加指向service的 controller OwnerReference，之后按service的annotation更新它
+	adoptPolicyAdopt = "adopt"
+	// adoptPolicyRename 不修改已存在的ingress，另外创建一个不冲突名称的ingress
+	adoptPolicyRename = "rename"
+)
+
+// AdoptPolicies 所有的处理方式
+var AdoptPolicies = []string{adoptPolicyIgnore, adoptPolicyAdopt, adoptPolicyRename}
+
+const (
+	// 已存在的ingress不由service控制，没有处理
+	reasonIngressExists = "IngressExists"
+	// 已存在的HTTPRoute不由service控制，没有处理
+	reasonHTTPRouteExists = "HTTPRouteExists"
+	// 接管了已存在的ingress或HTTPRoute
+	reasonAdopted = "Adopted"
+)
+
+// renamedName rename 模式下使用的ingress或HTTPRoute名称：service名称加上service UID的前8位。
+// 名称只与service本身有关，每次调谐都能找到同一个ingress
+func renamedName(service *corev1.Service) string {
+	uid := string(service.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	return fmt.Sprintf("%s-%s", service.Name, uid)
+}
+
+// ownedIngress 从缓存中找出由service控制的ingress，依次查找与service同名、以及 rename 模式下生成的名称。
+// 没有找到时返回 nil
+func (b *ingressBackend) ownedIngress(service *corev1.Service) (*netv1.Ingress, error) {
+	for _, name := range []string{service.Name, renamedName(service)} {
+		ingress, err := b.ingressLister.Ingresses(service.Namespace).Get(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if metav1.IsControlledBy(ingress, service) {
+			return ingress, nil
+		}
+	}
+	return nil, nil
+}
+
+// resolveConflict 与service同名的ingress已存在、但不是由service控制时，按 --adopt-policy 处理
+func (b *ingressBackend) resolveConflict(service *corev1.Service, existing, desired *netv1.Ingress) (syncOutcome, error) {
+	namespace := service.Namespace
+	switch b.opts.AdoptPolicy {
+	case adoptPolicyAdopt:
+		// ingress已经有其它的 controller，不能再接管
+		if owner := metav1.GetControllerOf(existing); owner != nil {
+			b.recorder.Eventf(service, corev1.EventTypeWarning, reasonIngressExists,
+				"Ingress %s/%s is controlled by %s %s, not adopting it", namespace, existing.Name, owner.Kind, owner.Name)
+			return outcomeSkipped, nil
+		}
+		// 以 server-side apply 写入 controller OwnerReference 和期望的内容，ingress上原有的 OwnerReference 会保留。
+		// 接管是用户通过 --adopt-policy 选择的，强制接管其它 field manager 设置的字段
+		outcome, err := b.applyIngress(service, existing, desired, true)
+		if err == nil {
+			b.recorder.Eventf(service, corev1.EventTypeNormal, reasonAdopted, "Adopted Ingress %s/%s", namespace, existing.Name)
+		}
+		return b.recordOutcome(service, outcome, "Ingress", namespace, existing.Name, err)
+	case adoptPolicyRename:
+		desired.Name = renamedName(service)
+		outcome, err := b.applyIngress(service, nil, desired, false)
+		return b.recordOutcome(service, outcome, "Ingress", namespace, desired.Name, err)
+	default:
+		b.recorder.Eventf(service, corev1.EventTypeWarning, reasonIngressExists,
+			"Ingress %s/%s already exists and is not controlled by this Service", namespace, existing.Name)
+		return outcomeSkipped, nil
+	}
+}
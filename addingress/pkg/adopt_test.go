@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	listernetv1 "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRenamedName(t *testing.T) {
+	service := ownerService()
+	service.UID = types.UID("0123456789abcdef")
+	if name := renamedName(service); name != "test-01234567" {
+		t.Errorf("Expected name test-01234567, got %q", name)
+	}
+}
+
+func TestOwnedIngress(t *testing.T) {
+	service := ownerService()
+	uncontrolled := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: service.Name, Namespace: service.Namespace}}
+	renamed := ownedIngress(service, "1")
+	renamed.Name = renamedName(service)
+
+	c := newQueueController()
+	c.ingressLister = listernetv1.NewIngressLister(newIndexer(uncontrolled, renamed))
+	b := &ingressBackend{controller: c}
+
+	// 同名的ingress不由service控制时，继续查找 rename 模式生成的ingress
+	ingress, err := b.ownedIngress(service)
+	if err != nil || ingress != renamed {
+		t.Errorf("Expected the renamed ingress, got %v, %v", ingress, err)
+	}
+
+	c.ingressLister = listernetv1.NewIngressLister(newIndexer(uncontrolled))
+	if ingress, err := b.ownedIngress(service); err != nil || ingress != nil {
+		t.Errorf("Expected no owned ingress, got %v, %v", ingress, err)
+	}
+}
+
+func TestResolveConflictWithoutWrites(t *testing.T) {
+	service := ownerService()
+	other := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: service.Namespace, UID: types.UID("other-uid")}}
+	tests := []struct {
+		name     string
+		policy   string
+		existing *netv1.Ingress
+		event    string
+	}{
+		{
+			name:     "ignore",
+			policy:   adoptPolicyIgnore,
+			existing: &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: service.Name, Namespace: service.Namespace}},
+			event:    "Warning " + reasonIngressExists + " Ingress default/test already exists",
+		},
+		{
+			name:     "default policy",
+			existing: &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: service.Name, Namespace: service.Namespace}},
+			event:    "Warning " + reasonIngressExists,
+		},
+		{
+			// 已经有 controller 的ingress不能被接管
+			name:     "adopt controlled ingress",
+			policy:   adoptPolicyAdopt,
+			existing: ownedIngress(other, "1"),
+			event:    "Warning " + reasonIngressExists + " Ingress default/other is controlled by Service other",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newQueueController()
+			recorder := record.NewFakeRecorder(10)
+			c.recorder = recorder
+			c.opts.AdoptPolicy = test.policy
+			b := &ingressBackend{controller: c}
+
+			outcome, err := b.resolveConflict(service, test.existing, ownedIngress(service, ""))
+			if outcome != outcomeSkipped || err != nil {
+				t.Errorf("Expected the ingress to be skipped, got %s, %v", outcome, err)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, test.event) {
+					t.Errorf("Expected event %q, got %q", test.event, event)
+				}
+			default:
+				t.Errorf("Expected event %q, got none", test.event)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sort"
+	"strings"
+)
+
+// 共享ingress上记录host的annotation，同时也用来区分共享的ingress和service独占的ingress
+const annoSharedHost = "ingress/shared-host"
+
+// sharedMember 共享ingress中的一个service，以及从它的annotation中解析出的参数
+type sharedMember struct {
+	service *corev1.Service
+	opts    *ingressOptions
+}
+
+// isSharedIngress 判断ingress是否为控制器创建的共享ingress
+func isSharedIngress(ingress *netv1.Ingress) bool {
+	_, ok := ingress.Annotations[annoSharedHost]
+	return ok
+}
+
+// sharedIngressName 共享ingress的名称就是host。通配符 * 不能出现在名称中，替换成 wildcard，
+// 并加上 host 的 hash 作为后缀，避免与字面上的 wildcard.example.com 使用相同的名称。
+// host 本身最长就有 253 个字符，加上 wildcard 和后缀后会超出名称的长度限制，所以先截断 host 部分
+func sharedIngressName(host string) string {
+	if !strings.HasPrefix(host, "*") {
+		return host
+	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(host))
+	suffix := fmt.Sprintf("-%08x", hasher.Sum32())
+	name := "wildcard" + strings.TrimPrefix(host, "*")
+	if limit := validation.DNS1123SubdomainMaxLength - len(suffix); len(name) > limit {
+		// 截断后不能以 . 或 - 结尾，否则和后缀拼接后不是合法的名称
+		name = strings.TrimRight(name[:limit], ".-")
+	}
+	return name + suffix
+}
+
+// syncSharedIngresses 共享ingress模式下，处理service的核心方法。
+// service 为 nil 表示service已经被删除。
+// service当前声明的host，以及service之前所在的共享ingress，都需要重新计算。
+// 只有使用 ingress 后端的service才会加入共享ingress
+func (c *controller) syncSharedIngresses(namespace, name string, service *corev1.Service) (syncOutcome, error) {
+	hosts := sets.NewString()
+
+	if service != nil {
+		if _, ok := service.Annotations[annoKey]; ok {
+			opts, err := c.parseIngressOptions(service)
+			if err != nil {
+				// annotation 不合法的service不会出现在任何共享ingress中
+				c.recorder.Event(service, corev1.EventTypeWarning, reasonInvalidAnnotation, err.Error())
+			} else if c.backendName(opts) == backendIngress {
+				hosts.Insert(opts.host)
+			}
+		}
+	}
+
+	// 找出包含这个service的共享ingress，service修改了host、删除了annotation、或者被删除时，需要从这些ingress中移除
+	ingresses, err := c.ingressLister.Ingresses(namespace).List(labels.Everything())
+	if err != nil {
+		return outcomeSkipped, err
+	}
+	for _, ingress := range ingresses {
+		if !isSharedIngress(ingress) {
+			continue
+		}
+		for _, ownerReference := range ingress.OwnerReferences {
+			if ownerReference.Kind == "Service" && ownerReference.Name == name {
+				hosts.Insert(ingress.Annotations[annoSharedHost])
+				break
+			}
+		}
+	}
+
+	outcome := outcomeSkipped
+	for _, host := range hosts.List() {
+		hostOutcome, err := c.syncSharedIngress(namespace, host)
+		// service已经被删除时，没有可以记录事件的对象
+		if service != nil {
+			hostOutcome, err = c.recordOutcome(service, hostOutcome, "Ingress", namespace, sharedIngressName(host), err)
+		}
+		outcome = outcome.merge(hostOutcome)
+		if err != nil {
+			return outcome, err
+		}
+	}
+	return outcome, nil
+}
+
+// syncSharedIngress 根据namespace中所有声明了host的service，创建、更新或删除host对应的共享ingress
+func (c *controller) syncSharedIngress(namespace, host string) (syncOutcome, error) {
+	members, err := c.sharedMembers(namespace, host)
+	if err != nil {
+		return outcomeSkipped, err
+	}
+
+	name := sharedIngressName(host)
+	ingress, err := c.ingressLister.Ingresses(namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return outcomeSkipped, err
+	}
+	// 同名的ingress不是这个host的共享ingress，不做处理
+	if ingress != nil && (!isSharedIngress(ingress) || ingress.Annotations[annoSharedHost] != host) {
+		return outcomeSkipped, nil
+	}
+
+	if len(members) == 0 {
+		// 已经没有service声明这个host了，删除共享ingress
+		if ingress == nil {
+			return outcomeSkipped, nil
+		}
+		err := c.ingresses(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			return outcomeSkipped, nil
+		}
+		return outcomeDeleted, err
+	}
+
+	// 不再属于这个host的service，其 OwnerReference 不在期望的ingress中，apply 后由apiserver删除。
+	// 事件由 syncSharedIngresses 记录在正在处理的service上
+	return c.applyIngress(nil, ingress, createSharedIngress(namespace, host, members), false)
+}
+
+// sharedMembers 找出namespace中声明了host的所有service，按名称排序
+func (c *controller) sharedMembers(namespace, host string) ([]sharedMember, error) {
+	services, err := c.serviceLister.Services(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var members []sharedMember
+	for _, service := range services {
+		if _, ok := service.Annotations[annoKey]; !ok {
+			continue
+		}
+		opts, err := c.parseIngressOptions(service)
+		if err != nil || opts.host != host || c.backendName(opts) != backendIngress {
+			continue
+		}
+		// 路由被其它namespace中的ingress占用的service，不加入共享ingress
+		if conflict, _, err := c.routeConflict(service, opts); err != nil {
+			return nil, err
+		} else if conflict != nil {
+			continue
+		}
+		members = append(members, sharedMember{service: service, opts: opts})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].service.Name < members[j].service.Name
+	})
+	return members, nil
+}
+
+// createSharedIngress 创建host对应的共享ingress，每个service对应一条path。
+// ingressClassName 使用第一个service的配置，TLS 使用第一个开启了TLS的service的配置；
+// 多个service声明了相同的path时，只保留第一个service的path。
+// 共享ingress不设置controller，每个service都是它的一个owner，所有service都被删除后由gc删除ingress
+func createSharedIngress(namespace, host string, members []sharedMember) *netv1.Ingress {
+	icn := members[0].opts.ingressClassName
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sharedIngressName(host),
+			Namespace: namespace,
+			Labels: map[string]string{
+				labelManagedBy: managedByValue,
+			},
+			Annotations: map[string]string{
+				annoSharedHost: host,
+			},
+		},
+		Spec: netv1.IngressSpec{
+			IngressClassName: &icn,
+			Rules: []netv1.IngressRule{
+				{
+					Host: host,
+					IngressRuleValue: netv1.IngressRuleValue{
+						HTTP: &netv1.HTTPIngressRuleValue{},
+					},
+				},
+			},
+		},
+	}
+
+	paths := sets.NewString()
+	tls := false
+	for _, member := range members {
+		ingress.OwnerReferences = append(ingress.OwnerReferences, metav1.OwnerReference{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+			Name:       member.service.Name,
+			UID:        member.service.UID,
+		})
+
+		for _, path := range ingressPaths(member.service, member.opts) {
+			if !paths.Has(path.Path) {
+				paths.Insert(path.Path)
+				http := ingress.Spec.Rules[0].HTTP
+				http.Paths = append(http.Paths, path)
+			}
+		}
+
+		if !tls && member.opts.tls {
+			tls = true
+			setIngressTLS(ingress, member.opts)
+		}
+	}
+	// 多个service设置了相同的annotation时，使用第一个service的值
+	for _, member := range members {
+		copyIngressAnnotations(ingress, member.opts)
+	}
+	return ingress
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSharedIngressName(t *testing.T) {
+	wildcard := sharedIngressName("*.example.com")
+	if !strings.HasPrefix(wildcard, "wildcard.example.com-") {
+		t.Errorf("Expected name of wildcard host to start with wildcard.example.com-, got %q", wildcard)
+	}
+	if literal := sharedIngressName("wildcard.example.com"); literal == wildcard {
+		t.Errorf("Expected different names for *.example.com and wildcard.example.com, both got %q", literal)
+	}
+	if name := sharedIngressName("app.example.com"); name != "app.example.com" {
+		t.Errorf("Expected name app.example.com, got %q", name)
+	}
+
+	// 最长的通配符host，截断后仍然是合法的名称
+	long := "*." + strings.Repeat(strings.Repeat("a", 62)+".", 3) + strings.Repeat("b", 61)
+	if msgs := validation.IsWildcardDNS1123Subdomain(long); len(msgs) != 0 {
+		t.Fatalf("Expected %q to be a valid wildcard host: %v", long, msgs)
+	}
+	name := sharedIngressName(long)
+	if msgs := validation.IsDNS1123Subdomain(name); len(msgs) != 0 {
+		t.Errorf("Expected name of long wildcard host to be valid, got %q: %v", name, msgs)
+	}
+	if other := sharedIngressName(strings.Replace(long, "b", "c", 1)); other == name {
+		t.Errorf("Expected different names for long hosts sharing a prefix, both got %q", name)
+	}
+}
+
+func TestCreateSharedIngress(t *testing.T) {
+	member := func(name string, annotations map[string]string) sharedMember {
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault, UID: types.UID(name + "-uid"), Annotations: annotations}}
+		opts, err := parseOptions(service)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return sharedMember{service: service, opts: opts}
+	}
+	members := []sharedMember{
+		member("api", map[string]string{annoKey: "true", annoPath: "/api"}),
+		member("duplicate", map[string]string{annoKey: "true", annoPath: "/api"}),
+		member("web", map[string]string{annoKey: "true", annoTLS: "true"}),
+	}
+
+	ingress := createSharedIngress(metav1.NamespaceDefault, defaultHost, members)
+	if !isSharedIngress(ingress) || ingress.Name != defaultHost {
+		t.Errorf("Expected shared ingress named %s, got %q with annotations %v", defaultHost, ingress.Name, ingress.Annotations)
+	}
+	// 每个service都是owner，但没有controller
+	if len(ingress.OwnerReferences) != 3 || metav1.GetControllerOf(ingress) != nil {
+		t.Errorf("Expected 3 owners without a controller, got %+v", ingress.OwnerReferences)
+	}
+	// 声明了相同path的service，只保留第一个
+	var backends []string
+	for _, path := range ingress.Spec.Rules[0].HTTP.Paths {
+		backends = append(backends, path.Path+" "+path.Backend.Service.Name)
+	}
+	if expected := []string{"/api api", "/ web"}; !reflect.DeepEqual(backends, expected) {
+		t.Errorf("Expected paths %v, got %v", expected, backends)
+	}
+	if len(ingress.Spec.TLS) != 1 || ingress.Spec.TLS[0].SecretName != "web-tls" {
+		t.Errorf("Expected TLS from the web service, got %+v", ingress.Spec.TLS)
+	}
+}
+
+func TestDeleteServiceEnqueuesOnlyWhenAggregating(t *testing.T) {
+	c := newQueueController()
+	tombstone := cache.DeletedFinalStateUnknown{Key: "default/test", Obj: ownerService()}
+
+	c.deleteService(tombstone)
+	expectQueue(t, c)
+
+	c.opts.AggregateByHost = true
+	c.deleteService(ownerService())
+	c.deleteService(tombstone)
+	expectQueue(t, c, "default/test")
+}
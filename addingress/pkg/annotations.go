@@ -0,0 +1,311 @@
+package pkg
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"strconv"
+	"strings"
+)
+
+// service 上用于描述 ingress 的 annotation。
+// 只有带 annoKey（ingress/http）的 service 才会生成 ingress，下面这些 annotation 都是可选的，不设置时使用默认值：
+//
+//	ingress/host       ingress 规则的 host，支持 *.example.com 形式的通配符。
+//	                   不设置时依次使用默认值 ConfigMap 中的 host-suffix、--host-template 渲染出的 host，都没有时默认 example.com
+//	ingress/path       转发的路径，必须以 / 开头，默认 /
+//	ingress/path-type  路径的匹配方式，可选 Exact、Prefix、ImplementationSpecific，默认 Prefix
+//	ingress/port       后端 service 的端口，可以是端口号（如 8080），也可以是端口名（如 http），必须是 service 上声明的端口。
+//	                   不设置时，service 只有一个端口就使用它，有多个端口时优先使用名为 http 的端口，否则使用第一个端口
+//	ingress/paths      一个 service 暴露多个端口时使用，逗号分隔的 path=port，比如 /api=grpc,/=http，每一项生成一条 path。
+//	                   与 ingress/path、ingress/port 不能同时设置
+//	ingress/class      ingress 的 ingressClassName，默认 ingress
+//
+// ingress/class 和下面 TLS 相关的 annotation，默认值可以通过默认值 ConfigMap 按 namespace 设置，见 defaults.go
+//
+// TLS 相关的 annotation：
+//
+//	ingress/tls             为 true 时为 host 开启 TLS，默认 false
+//	ingress/tls-secret      存放证书的 secret 名称，默认 <service名称>-tls
+//	ingress/cluster-issuer  由 cert-manager 的 ClusterIssuer 签发证书，设置后自动开启 TLS
+//	ingress/issuer          由 cert-manager 的 Issuer（与 service 同一个 namespace）签发证书，设置后自动开启 TLS
+//
+// ingress/cluster-issuer 和 ingress/issuer 只能设置一个。
+//
+// 路由后端：
+//
+//	ingress/backend  生成的路由对象，ingress 或 httproute，默认使用 --route-backend 参数。
+//	                 httproute 后端会忽略 ingress/class 和 TLS 相关的 annotation，TLS 由 Gateway 的 listener 负责
+//
+// 传递给 ingress controller 的 annotation：
+//
+//	以 --annotation-prefix（比如 ingress.addingress.io/）开头的 annotation，去掉前缀后复制到生成的 ingress 上，
+//	比如 ingress.addingress.io/nginx.ingress.kubernetes.io/proxy-body-size 复制为 nginx.ingress.kubernetes.io/proxy-body-size。
+//	从 service 上删除后，下一次调谐时也会从 ingress 上删除。httproute 后端会忽略这些 annotation
+//
+// ingress 分配到负载均衡地址后，控制器会在 service 上写入 ingress/url 和 ingress/load-balancer，见 address.go
+// service 声明的 host+path 已经被其它 ingress 占用时，控制器会在 service 上写入 ingress/conflict，见 collision.go
+const (
+	annoHost          = "ingress/host"
+	annoPath          = "ingress/path"
+	annoPathType      = "ingress/path-type"
+	annoPort          = "ingress/port"
+	annoPaths         = "ingress/paths"
+	annoClass         = "ingress/class"
+	annoTLS           = "ingress/tls"
+	annoTLSSecret     = "ingress/tls-secret"
+	annoClusterIssuer = "ingress/cluster-issuer"
+	annoIssuer        = "ingress/issuer"
+	annoBackend       = "ingress/backend"
+)
+
+// cert-manager 的 ingress-shim 会根据 ingress 上的这两个 annotation，为 spec.tls 中的 host 签发证书
+const (
+	certManagerClusterIssuer = "cert-manager.io/cluster-issuer"
+	certManagerIssuer        = "cert-manager.io/issuer"
+)
+
+// annotation 未设置时使用的默认值
+const (
+	defaultHost         = "example.com"
+	defaultPath         = "/"
+	defaultPathType     = netv1.PathTypePrefix
+	defaultPort         = 80
+	defaultIngressClass = "ingress"
+	// tls secret 名称的默认后缀
+	defaultTLSSecretSuffix = "-tls"
+)
+
+// ingressOptions 从 service 的 annotation 中解析出来的 ingress 参数
+type ingressOptions struct {
+	host string
+	// paths 转发到service的path，至少有一条
+	paths            []backendPath
+	pathType         netv1.PathType
+	ingressClassName string
+	// tls 为 true 时，ingress 会带上 spec.tls
+	tls           bool
+	tlsSecret     string
+	clusterIssuer string
+	issuer        string
+	// backend 为空时使用控制器的默认后端
+	backend string
+	// ingressAnnotations 去掉 --annotation-prefix 前缀后，复制到 ingress 上的 annotation
+	ingressAnnotations map[string]string
+}
+
+// parseIngressOptions 解析并校验 service 上的 annotation，所有不合法的值会合并成一个 error 返回
+func (c *controller) parseIngressOptions(service *corev1.Service) (*ingressOptions, error) {
+	opts := &ingressOptions{
+		host:             defaultHost,
+		pathType:         defaultPathType,
+		ingressClassName: defaultIngressClass,
+		tlsSecret:        service.Name + defaultTLSSecretSuffix,
+	}
+	// 默认值 ConfigMap 中设置的值，优先级高于内置的默认值，低于 annotation
+	defaults := c.ingressDefaults(service.Namespace)
+	if defaults.ingressClass != "" {
+		opts.ingressClassName = defaults.ingressClass
+	}
+	opts.tls = defaults.tls
+
+	var errs []error
+	annotations := service.Annotations
+
+	if host, ok := annotations[annoHost]; ok {
+		if err := validateHost(host); err != nil {
+			errs = append(errs, invalidAnnotation(annoHost, host, err))
+		} else {
+			opts.host = host
+		}
+	} else if defaults.hostSuffix != "" {
+		// ConfigMap 中的 host-suffix 优先于 --host-template，namespace 可以用它覆盖全局的模板
+		host := service.Name + "." + defaults.hostSuffix
+		if err := validateHost(host); err != nil {
+			errs = append(errs, fmt.Errorf("host %q built from %s %s: %v", host, DefaultsConfigMapName, defaultsKeyHostSuffix, err))
+		} else {
+			opts.host = host
+		}
+	} else if c.opts.HostTemplate != nil {
+		host, err := renderHost(c.opts.HostTemplate, service)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			opts.host = host
+		}
+	}
+
+	// 没有设置 ingress/paths 时，只有一条 path
+	single := pathPort{path: defaultPath}
+	if path, ok := annotations[annoPath]; ok {
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, invalidAnnotation(annoPath, path, fmt.Errorf("must be an absolute path")))
+		} else {
+			single.path = path
+		}
+	}
+
+	if pathType, ok := annotations[annoPathType]; ok {
+		switch netv1.PathType(pathType) {
+		case netv1.PathTypeExact, netv1.PathTypePrefix, netv1.PathTypeImplementationSpecific:
+			opts.pathType = netv1.PathType(pathType)
+		default:
+			errs = append(errs, invalidAnnotation(annoPathType, pathType,
+				fmt.Errorf("must be one of %s, %s, %s", netv1.PathTypeExact, netv1.PathTypePrefix, netv1.PathTypeImplementationSpecific)))
+		}
+	}
+
+	if port, ok := annotations[annoPort]; ok {
+		backendPort, err := parsePort(port)
+		if err != nil {
+			errs = append(errs, invalidAnnotation(annoPort, port, err))
+		} else {
+			single.port = &backendPort
+		}
+	}
+
+	pathPorts := []pathPort{single}
+	if value, ok := annotations[annoPaths]; ok {
+		_, hasPath := annotations[annoPath]
+		_, hasPort := annotations[annoPort]
+		if hasPath || hasPort {
+			errs = append(errs, fmt.Errorf("annotation %s is mutually exclusive with %s and %s", annoPaths, annoPath, annoPort))
+		} else if parsed, err := parsePathPorts(value); err != nil {
+			errs = append(errs, invalidAnnotation(annoPaths, value, err))
+		} else {
+			pathPorts = parsed
+		}
+	}
+	// 端口必须是service上声明的端口
+	for _, item := range pathPorts {
+		port, number, err := selectServicePort(service, item.port)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		opts.paths = append(opts.paths, backendPath{path: item.path, port: port, number: number})
+	}
+
+	if class, ok := annotations[annoClass]; ok {
+		if msgs := validation.IsDNS1123Subdomain(class); len(msgs) != 0 {
+			errs = append(errs, invalidAnnotation(annoClass, class, messagesError(msgs)))
+		} else {
+			opts.ingressClassName = class
+		}
+	}
+
+	if value, ok := annotations[annoTLS]; ok {
+		tls, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, invalidAnnotation(annoTLS, value, fmt.Errorf("must be true or false")))
+		} else {
+			opts.tls = tls
+		}
+	}
+
+	if secret, ok := annotations[annoTLSSecret]; ok {
+		if msgs := validation.IsDNS1123Subdomain(secret); len(msgs) != 0 {
+			errs = append(errs, invalidAnnotation(annoTLSSecret, secret, messagesError(msgs)))
+		} else {
+			opts.tlsSecret = secret
+		}
+	}
+
+	clusterIssuer, hasClusterIssuer := annotations[annoClusterIssuer]
+	issuer, hasIssuer := annotations[annoIssuer]
+	switch {
+	case hasClusterIssuer && hasIssuer:
+		errs = append(errs, fmt.Errorf("annotations %s and %s are mutually exclusive", annoClusterIssuer, annoIssuer))
+	case hasClusterIssuer:
+		if msgs := validation.IsDNS1123Subdomain(clusterIssuer); len(msgs) != 0 {
+			errs = append(errs, invalidAnnotation(annoClusterIssuer, clusterIssuer, messagesError(msgs)))
+		} else {
+			opts.clusterIssuer = clusterIssuer
+			opts.tls = true
+		}
+	case hasIssuer:
+		if msgs := validation.IsDNS1123Subdomain(issuer); len(msgs) != 0 {
+			errs = append(errs, invalidAnnotation(annoIssuer, issuer, messagesError(msgs)))
+		} else {
+			opts.issuer = issuer
+			opts.tls = true
+		}
+	default:
+		// annotation 没有指定 issuer，开启了TLS时使用默认值 ConfigMap 中的 issuer
+		if opts.tls {
+			opts.clusterIssuer = defaults.clusterIssuer
+			opts.issuer = defaults.issuer
+		}
+	}
+
+	if backend, ok := annotations[annoBackend]; ok {
+		switch backend {
+		case backendIngress, backendHTTPRoute:
+			opts.backend = backend
+		default:
+			errs = append(errs, invalidAnnotation(annoBackend, backend, fmt.Errorf("must be one of %s", strings.Join(backendNames, ", "))))
+		}
+	}
+
+	if prefix := c.opts.AnnotationPrefix; prefix != "" {
+		for key, value := range annotations {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			ingressKey := strings.TrimPrefix(key, prefix)
+			if msgs := validation.IsQualifiedName(strings.ToLower(ingressKey)); len(msgs) != 0 {
+				errs = append(errs, invalidAnnotation(key, value, fmt.Errorf("%q is not a valid annotation key: %v", ingressKey, messagesError(msgs))))
+				continue
+			}
+			if opts.ingressAnnotations == nil {
+				opts.ingressAnnotations = map[string]string{}
+			}
+			opts.ingressAnnotations[ingressKey] = value
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return opts, nil
+}
+
+// validateHost 校验 host 是否为合法的 DNS-1123 子域名，允许以 *. 开头的通配符域名
+func validateHost(host string) error {
+	var msgs []string
+	if strings.HasPrefix(host, "*.") {
+		msgs = validation.IsWildcardDNS1123Subdomain(host)
+	} else {
+		msgs = validation.IsDNS1123Subdomain(host)
+	}
+	if len(msgs) != 0 {
+		return messagesError(msgs)
+	}
+	return nil
+}
+
+// parsePort 将 annotation 的值解析为后端端口，纯数字按端口号处理，否则按端口名处理
+func parsePort(value string) (netv1.ServiceBackendPort, error) {
+	if number, err := strconv.Atoi(value); err == nil {
+		if msgs := validation.IsValidPortNum(number); len(msgs) != 0 {
+			return netv1.ServiceBackendPort{}, messagesError(msgs)
+		}
+		return netv1.ServiceBackendPort{Number: int32(number)}, nil
+	}
+	if msgs := validation.IsValidPortName(value); len(msgs) != 0 {
+		return netv1.ServiceBackendPort{}, messagesError(msgs)
+	}
+	return netv1.ServiceBackendPort{Name: value}, nil
+}
+
+// messagesError 将 validation 包返回的多条错误信息合并成一个 error
+func messagesError(msgs []string) error {
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// invalidAnnotation 生成 annotation 值不合法的错误信息
+func invalidAnnotation(key, value string, err error) error {
+	return fmt.Errorf("invalid annotation %s=%q: %v", key, value, err)
+}
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func annotatedService(annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault, Annotations: annotations},
+	}
+}
+
+// parseOptions 用默认参数的控制器解析service上的annotation
+func parseOptions(service *corev1.Service) (*ingressOptions, error) {
+	return newQueueController().parseIngressOptions(service)
+}
+
+func TestParseIngressOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    *ingressOptions
+	}{
+		{
+			name:        "defaults",
+			annotations: map[string]string{annoKey: "true"},
+			expected: &ingressOptions{
+				host:             defaultHost,
+				paths:            []backendPath{{path: defaultPath, port: netv1.ServiceBackendPort{Number: defaultPort}, number: defaultPort}},
+				pathType:         defaultPathType,
+				ingressClassName: defaultIngressClass,
+				tlsSecret:        "test-tls",
+			},
+		},
+		{
+			name: "all annotations",
+			annotations: map[string]string{
+				annoKey:      "true",
+				annoHost:     "*.example.com",
+				annoPath:     "/api",
+				annoPathType: "Exact",
+				annoPort:     "http",
+				annoClass:    "nginx",
+			},
+			expected: &ingressOptions{
+				host:             "*.example.com",
+				paths:            []backendPath{{path: "/api", port: netv1.ServiceBackendPort{Name: "http"}}},
+				pathType:         netv1.PathTypeExact,
+				ingressClassName: "nginx",
+				tlsSecret:        "test-tls",
+			},
+		},
+		{
+			name:        "port number",
+			annotations: map[string]string{annoKey: "true", annoPort: "8080"},
+			expected: &ingressOptions{
+				host:             defaultHost,
+				paths:            []backendPath{{path: defaultPath, port: netv1.ServiceBackendPort{Number: 8080}, number: 8080}},
+				pathType:         defaultPathType,
+				ingressClassName: defaultIngressClass,
+				tlsSecret:        "test-tls",
+			},
+		},
+		{
+			name:        "tls",
+			annotations: map[string]string{annoKey: "true", annoTLS: "true", annoTLSSecret: "example-cert"},
+			expected: &ingressOptions{
+				host:             defaultHost,
+				paths:            []backendPath{{path: defaultPath, port: netv1.ServiceBackendPort{Number: defaultPort}, number: defaultPort}},
+				pathType:         defaultPathType,
+				ingressClassName: defaultIngressClass,
+				tls:              true,
+				tlsSecret:        "example-cert",
+			},
+		},
+		{
+			name:        "cluster issuer enables tls",
+			annotations: map[string]string{annoKey: "true", annoClusterIssuer: "letsencrypt"},
+			expected: &ingressOptions{
+				host:             defaultHost,
+				paths:            []backendPath{{path: defaultPath, port: netv1.ServiceBackendPort{Number: defaultPort}, number: defaultPort}},
+				pathType:         defaultPathType,
+				ingressClassName: defaultIngressClass,
+				tls:              true,
+				tlsSecret:        "test-tls",
+				clusterIssuer:    "letsencrypt",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := parseOptions(annotatedService(test.annotations))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(opts, test.expected) {
+				t.Errorf("Expected %+v, got %+v", test.expected, opts)
+			}
+		})
+	}
+}
+
+func TestParseIngressOptionsInvalid(t *testing.T) {
+	annotations := map[string]string{
+		annoKey:      "true",
+		annoHost:     "Example.com",
+		annoPath:     "api",
+		annoPathType: "Regex",
+		annoPort:     "70000",
+		annoClass:    "under_score",
+		annoTLS:      "yes",
+	}
+	_, err := parseOptions(annotatedService(annotations))
+	if err == nil {
+		t.Fatal("Expected error for invalid annotations")
+	}
+	// 所有不合法的annotation合并在一个error中返回
+	for _, key := range []string{annoHost, annoPath, annoPathType, annoPort, annoClass, annoTLS} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected error to mention %s, got %v", key, err)
+		}
+	}
+}
+
+func TestParseIngressOptionsIssuersMutuallyExclusive(t *testing.T) {
+	annotations := map[string]string{annoKey: "true", annoClusterIssuer: "letsencrypt", annoIssuer: "local"}
+	if _, err := parseOptions(annotatedService(annotations)); err == nil {
+		t.Errorf("Expected error when both %s and %s are set", annoClusterIssuer, annoIssuer)
+	}
+}
+
+func TestParseIngressOptionsAnnotationPrefix(t *testing.T) {
+	service := annotatedService(map[string]string{
+		annoKey: "true",
+		"ingress.addingress.io/nginx.ingress.kubernetes.io/rewrite-target": "/",
+	})
+	// 没有设置 --annotation-prefix 时不复制
+	opts, err := parseOptions(service)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.ingressAnnotations != nil {
+		t.Errorf("Expected no annotations to copy, got %v", opts.ingressAnnotations)
+	}
+
+	c := newQueueController()
+	c.opts.AnnotationPrefix = "ingress.addingress.io/"
+	opts, err = c.parseIngressOptions(service)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{"nginx.ingress.kubernetes.io/rewrite-target": "/"}
+	if !reflect.DeepEqual(opts.ingressAnnotations, expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, opts.ingressAnnotations)
+	}
+
+	// 去掉前缀后不是合法的annotation key
+	service.Annotations["ingress.addingress.io/bad key"] = "value"
+	if _, err := c.parseIngressOptions(service); err == nil {
+		t.Errorf("Expected error for an invalid annotation key")
+	}
+}
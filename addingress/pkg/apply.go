@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1ac "k8s.io/client-go/applyconfigurations/meta/v1"
+	netv1ac "k8s.io/client-go/applyconfigurations/networking/v1"
+	"k8s.io/klog/v2"
+)
+
+// ingress 通过 server-side apply 写入，控制器只拥有自己设置的字段。
+// 其它工具在 ingress 上添加的 annotation、label 等字段不会被控制器覆盖，控制器不再设置的字段会由apiserver删除
+const fieldManager = "addingress"
+
+// reasonFieldConflict 控制器拥有的字段被其它 field manager 修改过，没有强制接管
+const reasonFieldConflict = "FieldConflict"
+
+// applyIngress 以 server-side apply 的方式写入期望的ingress，current 为缓存中的ingress，不存在时为 nil。
+// 只比较控制器拥有的字段，与期望一致时不写入。
+// 控制器拥有的字段被其它 field manager 修改过时，默认不覆盖这些字段，在service上记录Warning事件，service 为 nil 时只记录日志。
+// 设置了 --force-conflicts，或者 adopt 为 true（按 adopt 策略接管已存在的ingress）时，强制接管这些字段
+func (c *controller) applyIngress(service *corev1.Service, current, desired *netv1.Ingress, adopt bool) (syncOutcome, error) {
+	config := ingressApplyConfiguration(desired)
+	outcome := outcomeCreated
+	if current != nil {
+		// 从 managedFields 中取出控制器拥有的字段
+		applied, err := netv1ac.ExtractIngress(current, fieldManager)
+		if err != nil {
+			return outcomeSkipped, err
+		}
+		if equality.Semantic.DeepEqual(applied, config) {
+			return outcomeSkipped, nil
+		}
+		outcome = outcomeUpdated
+	}
+
+	force := adopt || c.opts.ForceConflicts
+	_, err := c.ingresses(desired.Namespace).Apply(context.TODO(), config, metav1.ApplyOptions{FieldManager: fieldManager, Force: force})
+	if errors.IsConflict(err) && !force {
+		// 重试也会冲突，不再重试，等待用户处理
+		if service != nil {
+			c.recorder.Eventf(service, corev1.EventTypeWarning, reasonFieldConflict,
+				"Fields of Ingress %s/%s are managed by another field manager, not overwriting them (set --force-conflicts to take them over): %v", desired.Namespace, desired.Name, err)
+		} else {
+			klog.InfoS("Not overwriting fields managed by another field manager", "ingress", klog.KRef(desired.Namespace, desired.Name), "err", err)
+		}
+		return outcomeSkipped, nil
+	}
+	return outcome, err
+}
+
+// ingressApplyConfiguration 将期望的ingress转换为 apply configuration，只包含控制器设置的字段
+func ingressApplyConfiguration(ingress *netv1.Ingress) *netv1ac.IngressApplyConfiguration {
+	config := netv1ac.Ingress(ingress.Name, ingress.Namespace)
+	if len(ingress.Labels) != 0 {
+		config.WithLabels(ingress.Labels)
+	}
+	if len(ingress.Annotations) != 0 {
+		config.WithAnnotations(ingress.Annotations)
+	}
+	for _, ownerReference := range ingress.OwnerReferences {
+		reference := metav1ac.OwnerReference().
+			WithAPIVersion(ownerReference.APIVersion).
+			WithKind(ownerReference.Kind).
+			WithName(ownerReference.Name).
+			WithUID(ownerReference.UID)
+		if ownerReference.Controller != nil {
+			reference.WithController(*ownerReference.Controller)
+		}
+		if ownerReference.BlockOwnerDeletion != nil {
+			reference.WithBlockOwnerDeletion(*ownerReference.BlockOwnerDeletion)
+		}
+		config.WithOwnerReferences(reference)
+	}
+
+	spec := netv1ac.IngressSpec()
+	if ingress.Spec.IngressClassName != nil {
+		spec.WithIngressClassName(*ingress.Spec.IngressClassName)
+	}
+	for _, rule := range ingress.Spec.Rules {
+		http := netv1ac.HTTPIngressRuleValue()
+		for _, path := range rule.HTTP.Paths {
+			http.WithPaths(httpIngressPathApplyConfiguration(path))
+		}
+		spec.WithRules(netv1ac.IngressRule().WithHost(rule.Host).WithHTTP(http))
+	}
+	for _, tls := range ingress.Spec.TLS {
+		tlsConfig := netv1ac.IngressTLS().WithHosts(tls.Hosts...)
+		if tls.SecretName != "" {
+			tlsConfig.WithSecretName(tls.SecretName)
+		}
+		spec.WithTLS(tlsConfig)
+	}
+	return config.WithSpec(spec)
+}
+
+// httpIngressPathApplyConfiguration 将一条path规则转换为 apply configuration，端口只设置端口名或端口号中的一个
+func httpIngressPathApplyConfiguration(path netv1.HTTPIngressPath) *netv1ac.HTTPIngressPathApplyConfiguration {
+	port := netv1ac.ServiceBackendPort()
+	if path.Backend.Service.Port.Name != "" {
+		port.WithName(path.Backend.Service.Port.Name)
+	} else {
+		port.WithNumber(path.Backend.Service.Port.Number)
+	}
+	config := netv1ac.HTTPIngressPath().
+		WithPath(path.Path).
+		WithBackend(netv1ac.IngressBackend().
+			WithService(netv1ac.IngressServiceBackend().
+				WithName(path.Backend.Service.Name).
+				WithPort(port)))
+	if path.PathType != nil {
+		config.WithPathType(*path.PathType)
+	}
+	return config
+}
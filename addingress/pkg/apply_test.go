@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	netv1 "k8s.io/api/networking/v1"
+)
+
+func TestIngressApplyConfiguration(t *testing.T) {
+	c := newQueueController()
+	opts, err := parseOptions(annotatedService(map[string]string{
+		annoKey:           "true",
+		annoHost:          "app.example.com",
+		annoPort:          "http",
+		annoClusterIssuer: "letsencrypt",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	desired := c.createIngress(ownerService(), opts)
+
+	// apply configuration 序列化后，就是发给apiserver的 apply patch
+	patch, err := json.Marshal(ingressApplyConfiguration(desired))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	applied := &netv1.Ingress{}
+	if err := json.Unmarshal(patch, applied); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if applied.Kind != "Ingress" || applied.APIVersion != netv1.SchemeGroupVersion.String() {
+		t.Errorf("Expected apply patch for networking.k8s.io/v1 Ingress, got %s %s", applied.APIVersion, applied.Kind)
+	}
+	applied.TypeMeta = desired.TypeMeta
+	if !reflect.DeepEqual(applied, desired) {
+		t.Errorf("Expected apply patch to contain every field of\n%+v\ngot\n%+v", desired, applied)
+	}
+
+	// 端口只设置端口名或端口号中的一个
+	var raw map[string]interface{}
+	json.Unmarshal(patch, &raw)
+	rules := raw["spec"].(map[string]interface{})["rules"].([]interface{})
+	path := rules[0].(map[string]interface{})["http"].(map[string]interface{})["paths"].([]interface{})[0]
+	port := path.(map[string]interface{})["backend"].(map[string]interface{})["service"].(map[string]interface{})["port"]
+	if expected := map[string]interface{}{"name": "http"}; !reflect.DeepEqual(port, expected) {
+		t.Errorf("Expected port %v, got %v", expected, port)
+	}
+}
@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// 路由后端的名称，可以通过 --route-backend 参数或 service 的 ingress/backend annotation 选择
+const (
+	// backendIngress 生成 networking/v1 的 Ingress
+	backendIngress = "ingress"
+	// backendHTTPRoute 生成 Gateway API 的 HTTPRoute
+	backendHTTPRoute = "httproute"
+)
+
+// backendNames 所有路由后端的名称，按固定顺序遍历
+var backendNames = []string{backendIngress, backendHTTPRoute}
+
+// routeBackend 把service暴露到集群外的一种路由对象，比如 Ingress、HTTPRoute。
+// 路由对象通过 controller 类型的 OwnerReference 归属于service
+type routeBackend interface {
+	// sync 根据service和解析出的annotation参数，创建或更新路由对象
+	sync(service *corev1.Service, opts *ingressOptions) (syncOutcome, error)
+	// cleanup 删除service对应的路由对象
+	cleanup(service *corev1.Service) (syncOutcome, error)
+}
+
+// backendName 返回service使用的路由后端，annotation 没有指定时使用 --route-backend 参数
+func (c *controller) backendName(opts *ingressOptions) string {
+	if opts.backend != "" {
+		return opts.backend
+	}
+	if c.opts.RouteBackend != "" {
+		return c.opts.RouteBackend
+	}
+	return backendIngress
+}
+
+// cleanupBackends 删除除 except 之外的所有后端中，由service生成的路由对象
+func (c *controller) cleanupBackends(service *corev1.Service, except string) (syncOutcome, error) {
+	outcome := outcomeSkipped
+	for _, name := range backendNames {
+		backend, ok := c.backends[name]
+		if !ok || name == except {
+			continue
+		}
+		backendOutcome, err := backend.cleanup(service)
+		outcome = outcome.merge(backendOutcome)
+		if err != nil {
+			return outcome, err
+		}
+	}
+	return outcome, nil
+}
+
+// syncOutcome 一次调谐对路由对象做了什么操作，作为监控指标的 label
+type syncOutcome string
+
+const (
+	outcomeCreated syncOutcome = "created"
+	outcomeUpdated syncOutcome = "updated"
+	outcomeDeleted syncOutcome = "deleted"
+	outcomeSkipped syncOutcome = "skipped"
+)
+
+// merge 合并多个路由对象的操作结果，以最后一个实际发生的操作为准
+func (o syncOutcome) merge(other syncOutcome) syncOutcome {
+	if other == outcomeSkipped {
+		return o
+	}
+	return other
+}
+
+// recordOutcome 根据对路由对象的操作结果，在service上记录事件，并原样返回操作结果。
+// 操作成功时记录Normal事件；与其它写入冲突时记录Warning事件，其它错误会重试，重试耗尽后由 handleError 记录事件
+func (c *controller) recordOutcome(service *corev1.Service, outcome syncOutcome, kind, namespace, name string, err error) (syncOutcome, error) {
+	if err != nil {
+		if errors.IsConflict(err) || errors.IsAlreadyExists(err) {
+			c.recorder.Eventf(service, corev1.EventTypeWarning, reasonConflict, "Conflict writing %s %s/%s, will retry: %v", kind, namespace, name, err)
+		}
+		return outcome, err
+	}
+	switch outcome {
+	case outcomeCreated:
+		c.recorder.Eventf(service, corev1.EventTypeNormal, reasonCreated, "Created %s %s/%s", kind, namespace, name)
+	case outcomeUpdated:
+		c.recorder.Eventf(service, corev1.EventTypeNormal, reasonUpdated, "Updated %s %s/%s", kind, namespace, name)
+	case outcomeDeleted:
+		c.recorder.Eventf(service, corev1.EventTypeNormal, reasonDeleted, "Deleted %s %s/%s", kind, namespace, name)
+	}
+	return outcome, nil
+}
@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestBackendName(t *testing.T) {
+	c := newQueueController()
+	opts, _ := parseOptions(annotatedService(map[string]string{annoKey: "true"}))
+	if name := c.backendName(opts); name != backendIngress {
+		t.Errorf("Expected default backend %s, got %s", backendIngress, name)
+	}
+
+	c.opts.RouteBackend = backendHTTPRoute
+	if name := c.backendName(opts); name != backendHTTPRoute {
+		t.Errorf("Expected --route-backend %s, got %s", backendHTTPRoute, name)
+	}
+
+	// annotation 优先于 --route-backend
+	opts, _ = parseOptions(annotatedService(map[string]string{annoKey: "true", annoBackend: backendIngress}))
+	if name := c.backendName(opts); name != backendIngress {
+		t.Errorf("Expected annotation backend %s, got %s", backendIngress, name)
+	}
+
+	if _, err := parseOptions(annotatedService(map[string]string{annoKey: "true", annoBackend: "gateway"})); err == nil {
+		t.Errorf("Expected error for unknown backend")
+	}
+}
+
+func TestRecordOutcome(t *testing.T) {
+	c := newQueueController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	service := ownerService()
+
+	tests := []struct {
+		outcome syncOutcome
+		err     error
+		event   string
+	}{
+		{outcome: outcomeCreated, event: "Normal " + reasonCreated + " Created Ingress default/test"},
+		{outcome: outcomeUpdated, event: "Normal " + reasonUpdated},
+		{outcome: outcomeDeleted, event: "Normal " + reasonDeleted},
+		{outcome: outcomeSkipped},
+		{outcome: outcomeUpdated, err: apierrors.NewConflict(netv1.Resource("ingresses"), "test", nil), event: "Warning " + reasonConflict},
+		// 其它错误由重试处理，重试耗尽后才记录事件
+		{outcome: outcomeUpdated, err: errors.New("connection refused")},
+	}
+	for _, test := range tests {
+		outcome, err := c.recordOutcome(service, test.outcome, "Ingress", service.Namespace, service.Name, test.err)
+		if outcome != test.outcome || err != test.err {
+			t.Errorf("Expected %s, %v to be returned unchanged, got %s, %v", test.outcome, test.err, outcome, err)
+		}
+		select {
+		case event := <-recorder.Events:
+			if test.event == "" || !strings.HasPrefix(event, test.event) {
+				t.Errorf("Expected event %q for %s, %v, got %q", test.event, test.outcome, test.err, event)
+			}
+		default:
+			if test.event != "" {
+				t.Errorf("Expected event %q for %s, %v, got none", test.event, test.outcome, test.err)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// 控制器生成的ingress都带有这个label，用来在所有ingress中找出由控制器管理的ingress
+const (
+	labelManagedBy = "app.kubernetes.io/managed-by"
+	managedByValue = controllerAgentName
+)
+
+// indexHostPath ingress indexer 的索引名，按 host+path 索引由控制器管理的ingress
+const indexHostPath = "hostPath"
+
+// indexConflictRoute service indexer 的索引名，按被占用的 host+path 索引路由冲突的service
+const indexConflictRoute = "conflictRoute"
+
+const (
+	// annoConflict 控制器写回 service 的 annotation，记录 service 声明的路由被哪个ingress占用
+	annoConflict = "ingress/conflict"
+	// 路由已经被其它 service 的ingress占用
+	reasonRouteConflict = "RouteConflict"
+	// conflictClaimedBy annoConflict 中分隔路由和占用路由的ingress的文本
+	conflictClaimedBy = " is claimed by Ingress "
+)
+
+// hostPathIndexFunc 为由控制器管理的ingress中的每条 path 生成 host+path 索引，比如 example.com/api
+func hostPathIndexFunc(obj interface{}) ([]string, error) {
+	ingress, ok := obj.(*netv1.Ingress)
+	if !ok || ingress.Labels[labelManagedBy] != managedByValue {
+		return nil, nil
+	}
+	var keys []string
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			keys = append(keys, rule.Host+path.Path)
+		}
+	}
+	return keys, nil
+}
+
+// routeConflict 在所有监听的namespace中，查找占用了service声明的 host+path 的ingress，见 findRouteConflict。
+// service先声明的路由被后来的ingress占用时（比如开启这个功能之前已经存在的重复ingress），让后来的ingress的owner重新调谐
+func (c *controller) routeConflict(service *corev1.Service, opts *ingressOptions) (*netv1.Ingress, string, error) {
+	conflict, route, later, err := c.findRouteConflict(service, opts)
+	for _, ingress := range later {
+		c.enqueueOwner(ingress)
+	}
+	return conflict, route, err
+}
+
+// findRouteConflict 查找占用了service声明的 host+path 的ingress，不修改workqueue，也不记录事件，可以在 webhook 中调用。
+// 同一条路由以最早的声明为准：service的声明时间是包含它的ingress中最早的创建时间，还没有ingress时晚于所有已存在的ingress。
+// 返回占用路由的ingress和路由，没有冲突时返回 nil；later 是比service更晚声明、却占用了service的路由的ingress
+func (c *controller) findRouteConflict(service *corev1.Service, opts *ingressOptions) (conflict *netv1.Ingress, route string, later []*netv1.Ingress, err error) {
+	claimed, hasClaim, err := c.claimTime(service)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	for _, route := range serviceRoutes(opts) {
+		for _, indexer := range c.ingressIndexers {
+			objs, err := indexer.ByIndex(indexHostPath, route)
+			if err != nil {
+				return nil, "", later, err
+			}
+			for _, obj := range objs {
+				ingress := obj.(*netv1.Ingress)
+				if referencesService(ingress, service) {
+					continue
+				}
+				if !hasClaim || claimedEarlier(ingress, claimed, service) {
+					return ingress, route, later, nil
+				}
+				later = append(later, ingress)
+			}
+		}
+	}
+	return nil, "", later, nil
+}
+
+// serviceRoutes 返回service声明的所有 host+path，与 hostPathIndexFunc 生成的索引一致
+func serviceRoutes(opts *ingressOptions) []string {
+	routes := make([]string, 0, len(opts.paths))
+	for _, path := range opts.paths {
+		routes = append(routes, opts.host+path.path)
+	}
+	return routes
+}
+
+// claimTime 返回包含service的ingress中最早的创建时间，没有这样的ingress时 hasClaim 为 false
+func (c *controller) claimTime(service *corev1.Service) (claimed metav1.Time, hasClaim bool, err error) {
+	ingresses, err := c.ingressLister.Ingresses(service.Namespace).List(labels.SelectorFromSet(labels.Set{labelManagedBy: managedByValue}))
+	if err != nil {
+		return claimed, false, err
+	}
+	for _, ingress := range ingresses {
+		if !referencesService(ingress, service) {
+			continue
+		}
+		if !hasClaim || ingress.CreationTimestamp.Before(&claimed) {
+			claimed = ingress.CreationTimestamp
+			hasClaim = true
+		}
+	}
+	return claimed, hasClaim, nil
+}
+
+// claimedEarlier 判断 ingress 是否比service更早声明路由，创建时间相同时按 namespace/name 排序
+func claimedEarlier(ingress *netv1.Ingress, claimed metav1.Time, service *corev1.Service) bool {
+	if !ingress.CreationTimestamp.Equal(&claimed) {
+		return ingress.CreationTimestamp.Before(&claimed)
+	}
+	return ingress.Namespace+"/"+ingress.Name < service.Namespace+"/"+service.Name
+}
+
+// referencesService 判断ingress的 ownerReferences 中是否包含service
+func referencesService(ingress *netv1.Ingress, service *corev1.Service) bool {
+	for _, ownerReference := range ingress.OwnerReferences {
+		if ownerReference.UID == service.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// updateServiceConflict 将路由冲突写回service的annotation，ingress 为 nil 时删除这个annotation
+func (c *controller) updateServiceConflict(service *corev1.Service, ingress *netv1.Ingress, route string) error {
+	desired := map[string]string{}
+	if ingress != nil {
+		desired[annoConflict] = route + conflictClaimedBy + ingress.Namespace + "/" + ingress.Name
+	}
+	return c.patchServiceAnnotations(service, []string{annoConflict}, desired)
+}
+
+// conflictRouteIndexFunc 按 annoConflict 中记录的被占用路由索引service，没有冲突的service不建索引
+func conflictRouteIndexFunc(obj interface{}) ([]string, error) {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil, nil
+	}
+	conflict, ok := service.Annotations[annoConflict]
+	if !ok {
+		return nil, nil
+	}
+	return []string{strings.SplitN(conflict, conflictClaimedBy, 2)[0]}, nil
+}
+
+// enqueueClaimants ingress 的路由发生变化后，声明了这些路由的service重新检查冲突：
+// 路由被占用的service看能否拿到路由，占用同一条路由的其它ingress的owner按声明时间重新决定路由归属
+func (c *controller) enqueueClaimants(ingresses ...*netv1.Ingress) {
+	for _, ingress := range ingresses {
+		routes, _ := hostPathIndexFunc(ingress)
+		for _, route := range routes {
+			for _, indexer := range c.serviceIndexers {
+				objs, err := indexer.ByIndex(indexConflictRoute, route)
+				if err != nil {
+					runtime.HandleError(err)
+					continue
+				}
+				for _, obj := range objs {
+					c.enqueue(obj)
+				}
+			}
+			for _, indexer := range c.ingressIndexers {
+				objs, err := indexer.ByIndex(indexHostPath, route)
+				if err != nil {
+					runtime.HandleError(err)
+					continue
+				}
+				for _, obj := range objs {
+					if other := obj.(*netv1.Ingress); other.UID != ingress.UID {
+						c.enqueueOwner(other)
+					}
+				}
+			}
+		}
+	}
+}
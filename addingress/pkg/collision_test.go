@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	listernetv1 "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// managedIngress 返回由控制器管理、被 owner 控制、占用 host+path 的ingress
+func managedIngress(name string, owner *corev1.Service, host, path string) *netv1.Ingress {
+	return &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       metav1.NamespaceDefault,
+			UID:             types.UID(name + "-ingress-uid"),
+			ResourceVersion: "1",
+			Generation:      1,
+			Labels:          map[string]string{labelManagedBy: managedByValue},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(owner, corev1.SchemeGroupVersion.WithKind("Service"))},
+		},
+		Spec: netv1.IngressSpec{Rules: []netv1.IngressRule{{
+			Host: host,
+			IngressRuleValue: netv1.IngressRuleValue{HTTP: &netv1.HTTPIngressRuleValue{
+				Paths: []netv1.HTTPIngressPath{{Path: path}},
+			}},
+		}}},
+	}
+}
+
+// hostPathService 返回声明了 example.com/ 路由的service
+func hostPathService(name, namespace string) *corev1.Service {
+	return &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   namespace,
+		UID:         types.UID(namespace + "-" + name + "-uid"),
+		Annotations: map[string]string{annoKey: "true", annoHost: "example.com"},
+	}}
+}
+
+func TestHostPathIndexFunc(t *testing.T) {
+	ingress := managedIngress("test", ownerService(), "example.com", "/api")
+	keys, err := hostPathIndexFunc(ingress)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"example.com/api"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+
+	// 不是由控制器管理的ingress不参与冲突检测
+	ingress.Labels = nil
+	if keys, _ := hostPathIndexFunc(ingress); len(keys) != 0 {
+		t.Errorf("Expected no keys for an unmanaged ingress, got %v", keys)
+	}
+}
+
+func TestRouteConflict(t *testing.T) {
+	early := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	late := metav1.NewTime(early.Add(time.Hour))
+
+	owner := hostPathService("owner", "team-a")
+	existing := managedIngress("owner", owner, "example.com", "/")
+	existing.Namespace = owner.Namespace
+	existing.CreationTimestamp = late
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		indexHostPath:        hostPathIndexFunc,
+	})
+	indexer.Add(existing)
+	c := newQueueController()
+	c.ingressLister = listernetv1.NewIngressLister(indexer)
+	c.ingressIndexers = []cache.Indexer{indexer}
+
+	// 还没有ingress的service，晚于已存在的ingress
+	service := hostPathService("test", "team-b")
+	opts, err := parseOptions(service)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conflict, route, err := c.routeConflict(service, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if conflict != existing || route != "example.com/" {
+		t.Errorf("Expected example.com/ to be claimed by team-a/owner, got %v %q", conflict, route)
+	}
+	expectQueue(t, c)
+
+	// owner自己的ingress不算冲突
+	if conflict, _, _ := c.routeConflict(owner, opts); conflict != nil {
+		t.Errorf("Expected no conflict for the owner, got %s/%s", conflict.Namespace, conflict.Name)
+	}
+
+	// service更早声明了路由，后来的ingress的owner重新调谐
+	claimed := managedIngress("test", service, "example.com", "/")
+	claimed.Namespace = service.Namespace
+	claimed.CreationTimestamp = early
+	indexer.Add(claimed)
+	if conflict, _, _ := c.routeConflict(service, opts); conflict != nil {
+		t.Errorf("Expected no conflict for the earlier claim, got %s/%s", conflict.Namespace, conflict.Name)
+	}
+	expectQueue(t, c, "team-a/owner")
+}
+
+func TestIngressEventsEnqueueClaimants(t *testing.T) {
+	f := newFixture(t)
+	owner := newService("owner", nil)
+	conflicted := newService("conflicted", map[string]string{annoConflict: "example.com/" + conflictClaimedBy + "default/owner"})
+	other := newService("other", map[string]string{annoConflict: "other.example.com/" + conflictClaimedBy + "default/elsewhere"})
+	existing := managedIngress("owner", owner, "example.com", "/")
+	f.serviceLister = append(f.serviceLister, owner, conflicted, other)
+	f.ingressLister = append(f.ingressLister, existing)
+	c, _ := f.newController()
+
+	duplicate := managedIngress("duplicate", newService("late", nil), "example.com", "/")
+	c.addIngress(duplicate)
+	keys := map[string]bool{}
+	for c.queue.Len() > 0 {
+		key, _ := c.queue.Get()
+		keys[key.(string)] = true
+		c.queue.Done(key)
+	}
+	expected := map[string]bool{getKey(owner, t): true, getKey(conflicted, t): true}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v to be enqueued, got %v", expected, keys)
+	}
+
+	// 只有 status 变化时只将ingress的owner加入队列，不重新检查冲突
+	updated := existing.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	c.updateIngress(existing, updated)
+	if c.queue.Len() != 1 {
+		t.Errorf("Expected only the owner to be enqueued on a status update, got %d keys", c.queue.Len())
+	}
+}
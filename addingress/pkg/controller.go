@@ -1,7 +1,7 @@
 package pkg
 
 import (
-	"context"
+	"fmt"
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -11,11 +11,17 @@ import (
 	informercorev1 "k8s.io/client-go/informers/core/v1"
 	informernetv1 "k8s.io/client-go/informers/networking/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	listercorev1 "k8s.io/client-go/listers/core/v1"
 	listernetv1 "k8s.io/client-go/listers/networking/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
 	"reflect"
+	"sync"
+	"text/template"
 	"time"
 )
 
@@ -26,45 +32,158 @@ const (
 	annoKey = "ingress/http"
 	// 调谐失败的最大重试次数
 	maxRetry = 10
+	// 控制器名称，作为事件的来源
+	controllerAgentName = "addingress-controller"
 )
 
+// 记录在 service 上的事件的 reason
+const (
+	// service 的 annotation 值不合法
+	reasonInvalidAnnotation = "InvalidAnnotation"
+	// 创建了路由对象
+	reasonCreated = "Created"
+	// 更新了路由对象
+	reasonUpdated = "Updated"
+	// 删除了路由对象
+	reasonDeleted = "Deleted"
+	// 写路由对象时与其它写入冲突，会稍后重试
+	reasonConflict = "Conflict"
+	// 重试 maxRetry 次后仍然失败，不再处理
+	reasonSyncFailed = "SyncFailed"
+)
+
+// Options 控制器的可选配置，由命令行参数设置
+type Options struct {
+	// AggregateByHost 为 true 时，同一个namespace中声明了相同host的service，共用一个ingress，每个service对应其中的一条path
+	AggregateByHost bool
+	// RouteBackend service 没有通过 annotation 指定路由后端时使用的后端，默认为 ingress
+	RouteBackend string
+	// AdoptPolicy 与service同名的ingress或HTTPRoute已存在、但不是由service控制时的处理方式：ignore、adopt 或 rename，默认为 ignore
+	AdoptPolicy string
+	// ForceConflicts 为 true 时，强制接管ingress上被其它 field manager 修改过的、控制器拥有的字段；默认只记录Warning事件
+	ForceConflicts bool
+	// DryRun 为 true 时不写入路由对象和事件，只在日志中记录计划中的修改
+	DryRun bool
+	// HostTemplate service 没有设置 ingress/host 时，用来生成 host 的模板，见 renderHost
+	HostTemplate *template.Template
+	// AnnotationPrefix service 上以这个前缀开头的annotation，去掉前缀后复制到ingress上，为空时不复制
+	AnnotationPrefix string
+}
+
 // 自定义控制器
 type controller struct {
 	client        kubernetes.Interface
 	serviceLister listercorev1.ServiceLister
 	ingressLister listernetv1.IngressLister
 	queue         workqueue.RateLimitingInterface
+	recorder      record.EventRecorder
+	opts          Options
+	// backends 已启用的路由后端，key 为后端名称
+	backends map[string]routeBackend
+	// synced 所有informer的 HasSynced，全部同步完成后控制器才处于就绪状态
+	synced []cache.InformerSynced
+	// dryRun dry-run 模式下记录计划中的修改，非 dry-run 模式下为 nil
+	dryRun *dryRunPlan
+	// configMapLister 默认值 ConfigMap 的缓存，没有启用默认值时为 nil
+	configMapLister listercorev1.ConfigMapLister
+	// globalNamespace 全局默认值 ConfigMap 所在的namespace
+	globalNamespace string
+	// defaultsCache 校验过的默认值，没有启用默认值时为 nil
+	defaultsCache *defaultsCache
+	// ingressIndexers 每个ingress informer的indexer，按 host+path 索引由控制器管理的ingress，用于检测路由冲突
+	ingressIndexers []cache.Indexer
+	// serviceIndexers 每个service informer的indexer，按被占用的路由索引路由冲突的service
+	serviceIndexers []cache.Indexer
 }
 
-// NewController 创建一个自定义控制器
-func NewController(clientset *kubernetes.Clientset, serviceInformer informercorev1.ServiceInformer, ingressInformer informernetv1.IngressInformer) *controller {
-	// 控制器中，包含一个clientset、service和ingress的缓存监听器、一个workqueue
+// NewController 创建一个自定义控制器。
+// 控制器只监听部分namespace时，每个namespace都有各自的informer，serviceInformers 和 ingressInformers 中各有一个；监听整个集群时，各只有一个
+func NewController(clientset kubernetes.Interface, serviceInformers []informercorev1.ServiceInformer, ingressInformers []informernetv1.IngressInformer, opts Options) *controller {
+	// 创建事件广播器，将事件写入 apiserver，便于 service 的使用者通过 kubectl describe 看到处理结果
+	// dry-run 模式下事件只输出到日志
+	eventBroadcaster := record.NewBroadcaster()
+	if opts.DryRun {
+		eventBroadcaster.StartStructuredLogging(0)
+	} else {
+		eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	}
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
+
+	// 合并所有informer的lister
+	var serviceLister multiServiceLister
+	for _, serviceInformer := range serviceInformers {
+		serviceLister = append(serviceLister, serviceInformer.Lister())
+	}
+	var ingressLister multiIngressLister
+	for _, ingressInformer := range ingressInformers {
+		ingressLister = append(ingressLister, ingressInformer.Lister())
+	}
+
+	// 控制器中，包含一个clientset、service和ingress的缓存监听器、一个workqueue、一个事件记录器
 	c := controller{
 		client:        clientset,
-		serviceLister: serviceInformer.Lister(),
-		ingressLister: ingressInformer.Lister(),
+		serviceLister: serviceLister,
+		ingressLister: ingressLister,
 		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "ingressManager"),
+		recorder:      recorder,
+		opts:          opts,
+	}
+	if opts.DryRun {
+		c.dryRun = &dryRunPlan{changes: map[string]plannedChange{}}
+	}
+	// ingress 后端始终启用，其它后端需要单独启用
+	c.backends = map[string]routeBackend{
+		backendIngress: &ingressBackend{controller: &c},
 	}
 
 	// 为 serviceInformer 添加 ResourceEventHandler
-	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		// 添加service时触发
-		AddFunc: c.addService,
-		// 修改service时触发
-		UpdateFunc: c.updateService,
-		// 这里没有删除service的逻辑，因为我们会使用 OwnerReferences 将service+ingress关联起来。
-		// 因此删除service，会由kubernetes的ControllerManager中的特殊Controller，自动完成ingress的gc
-	})
+	for _, serviceInformer := range serviceInformers {
+		serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			// 添加service时触发
+			AddFunc: c.addService,
+			// 修改service时触发
+			UpdateFunc: c.updateService,
+			// 删除service时触发。
+			// 独占的ingress通过 OwnerReferences 与service关联，删除service后，由kubernetes的ControllerManager中的特殊Controller自动完成ingress的gc；
+			// 共享的ingress只有在所有service都删除后才会被gc，所以需要把被删除service对应的path从共享的ingress中移除
+			DeleteFunc: c.deleteService,
+		})
+		c.synced = append(c.synced, serviceInformer.Informer().HasSynced)
+		if err := serviceInformer.Informer().AddIndexers(cache.Indexers{indexConflictRoute: conflictRouteIndexFunc}); err != nil {
+			runtime.HandleError(err)
+		}
+		c.serviceIndexers = append(c.serviceIndexers, serviceInformer.Informer().GetIndexer())
+	}
 
 	// 为 ingressInformer 添加 ResourceEventHandler
-	ingressInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		// 删除ingress时触发
-		DeleteFunc: c.deleteIngress,
-	})
-
+	for _, ingressInformer := range ingressInformers {
+		ingressInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			// 添加ingress时触发，新的ingress可能和已有的ingress占用同一条路由
+			AddFunc: c.addIngress,
+			// 修改ingress时触发，用于还原对ingress的手动修改，以及将 status 中的负载均衡地址写回service
+			UpdateFunc: c.updateIngress,
+			// 删除ingress时触发
+			DeleteFunc: c.deleteIngress,
+		})
+		c.synced = append(c.synced, ingressInformer.Informer().HasSynced)
+		if err := ingressInformer.Informer().AddIndexers(cache.Indexers{indexHostPath: hostPathIndexFunc}); err != nil {
+			runtime.HandleError(err)
+		}
+		c.ingressIndexers = append(c.ingressIndexers, ingressInformer.Informer().GetIndexer())
+	}
 	return &c
 }
 
+// HasSynced 所有informer的缓存都完成同步后返回 true，用于 /readyz
+func (c *controller) HasSynced() bool {
+	for _, synced := range c.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
 // 添加service时触发
 func (c *controller) addService(obj interface{}) {
 	// 将 添加service 的 key 加入 workqueue
@@ -77,22 +196,102 @@ func (c *controller) updateService(oldObj interface{}, newObj interface{}) {
 	if reflect.DeepEqual(oldObj, newObj) {
 		return
 	}
-	// todo 比较annotation
+	// 只有 annotation、label（用于 --host-template）或 spec 变化才会影响生成的ingress，status 等其它字段的变化无需处理
+	oldService := oldObj.(*corev1.Service)
+	newService := newObj.(*corev1.Service)
+	if reflect.DeepEqual(oldService.Annotations, newService.Annotations) && reflect.DeepEqual(oldService.Labels, newService.Labels) &&
+		reflect.DeepEqual(oldService.Spec, newService.Spec) {
+		return
+	}
 	// 将 修改service 的 key 加入 workqueue
 	c.enqueue(newObj)
 }
 
+// 删除service时触发
+func (c *controller) deleteService(obj interface{}) {
+	// 只有共享ingress的模式下才需要处理
+	if !c.opts.AggregateByHost {
+		return
+	}
+	// 如果informer错过了删除事件，拿到的是 DeletedFinalStateUnknown，DeletionHandlingMetaNamespaceKeyFunc 可以直接处理
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// 修改ingress时触发
+func (c *controller) updateIngress(oldObj interface{}, newObj interface{}) {
+	oldIngress := oldObj.(*netv1.Ingress)
+	newIngress := newObj.(*netv1.Ingress)
+	// resourceVersion 相同，说明是informer的定期resync，ingress并没有变化
+	if oldIngress.ResourceVersion == newIngress.ResourceVersion {
+		return
+	}
+	// 将拥有这个ingress的service加入workqueue，由syncService把ingress还原成期望的样子
+	c.enqueueOwner(newIngress)
+	// 只有路由变化时才需要重新检查冲突，status 等其它字段的变化（比如写回负载均衡地址）无需处理
+	if oldIngress.Generation == newIngress.Generation && reflect.DeepEqual(oldIngress.Spec.Rules, newIngress.Spec.Rules) &&
+		oldIngress.Labels[labelManagedBy] == newIngress.Labels[labelManagedBy] {
+		return
+	}
+	// 释放的路由和新占用的路由，声明了这些路由的service都重新检查冲突
+	c.enqueueClaimants(oldIngress, newIngress)
+}
+
+// 添加ingress时触发
+func (c *controller) addIngress(obj interface{}) {
+	c.enqueueClaimants(obj.(*netv1.Ingress))
+}
+
 // 删除ingress时触发
 func (c *controller) deleteIngress(obj interface{}) {
-	// 将对象转成ingress，并获取到它的 ownerReference
-	ingress := obj.(*netv1.Ingress)
-	ownerReference := metav1.GetControllerOf(ingress)
-	// 如果ingress的 ownerReference 没有绑定到service，则无需处理
+	// 将对象转成ingress。如果informer错过了删除事件，拿到的是 DeletedFinalStateUnknown，需要从中取出ingress
+	ingress, ok := obj.(*netv1.Ingress)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("couldn't get object from tombstone %#v", obj))
+			return
+		}
+		ingress, ok = tombstone.Obj.(*netv1.Ingress)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("tombstone contained object that is not an Ingress %#v", obj))
+			return
+		}
+	}
+	// 将拥有这个ingress的service加入workqueue，重新创建ingress
+	c.enqueueOwner(ingress)
+	// ingress占用的路由被释放，路由被占用的service重新检查冲突
+	c.enqueueClaimants(ingress)
+}
+
+// enqueueOwner 将 控制ingress的service 的 key 加入 workqueue
+func (c *controller) enqueueOwner(ingress *netv1.Ingress) {
+	// 共享的ingress没有controller，它的每个 ownerReference 都指向一个service
+	if isSharedIngress(ingress) {
+		for _, ownerReference := range ingress.OwnerReferences {
+			if ownerReference.Kind == "Service" {
+				c.queue.Add(ingress.Namespace + "/" + ownerReference.Name)
+			}
+		}
+		return
+	}
+	c.enqueueController(ingress)
+}
+
+// enqueueController 将 控制路由对象的service 的 key 加入 workqueue
+func (c *controller) enqueueController(obj metav1.Object) {
+	// 获取路由对象的 ownerReference
+	ownerReference := metav1.GetControllerOf(obj)
+	// 如果路由对象的 ownerReference 没有绑定到service，则无需处理
 	if ownerReference == nil || ownerReference.Kind != "Service" {
 		return
 	}
-	// 如果ingress的 ownerReference 已经绑定到service，则需要处理
-	c.enqueue(obj)
+	// ownerReference 只能指向同一个namespace下的对象，所以 service 的 key 就是 ns/ownerName
+	c.queue.Add(obj.GetNamespace() + "/" + ownerReference.Name)
 }
 
 // enqueue 将 待添加service 的 key 加入 workqueue
@@ -113,15 +312,32 @@ func (c *controller) dequeue(item interface{}) {
 	c.queue.Done(item)
 }
 
-// Run 启动controller
-func (c *controller) Run(stopCh chan struct{}) {
+// Run 启动controller，stopCh 关闭后，等待已经取出和还在队列中的key处理完成再返回
+func (c *controller) Run(stopCh <-chan struct{}) {
+	// 用于处理程序崩溃，发生未捕获的异常（panic）时，记录日志并发出报告
+	defer runtime.HandleCrash()
+
 	// 启动多个worker，同时对workqueue中的事件进行处理，效率提升5倍
+	var wg sync.WaitGroup
 	for i := 0; i < workNum; i++ {
+		wg.Add(1)
 		// 每个worker都是一个协程，使用同一个停止信号
-		go wait.Until(c.worker, time.Minute, stopCh)
+		go func() {
+			defer wg.Done()
+			wait.Until(c.worker, time.Minute, stopCh)
+		}()
 	}
+	klog.Info("Started workers")
+
 	// 启动完成后，Run函数就停止在这里，等待停止信号
 	<-stopCh
+
+	// 收到停止信号后，workqueue不再接收新的key。
+	// ShutDownWithDrain 会等待正在处理的key调用 Done；worker会继续取出队列中剩余的key，直到队列为空后退出
+	klog.Info("Shutting down workers, draining workqueue")
+	c.queue.ShutDownWithDrain()
+	wg.Wait()
+	klog.Info("Workers stopped")
 }
 
 // worker方法
@@ -146,8 +362,10 @@ func (c *controller) processNextItem() bool {
 	// 转成string类型的key
 	key := item.(string)
 
-	// 处理service逻辑的核心方法
-	err := c.syncService(key)
+	// 处理service逻辑的核心方法，记录处理耗时和结果
+	start := time.Now()
+	outcome, err := c.syncService(key)
+	observeSync(outcome, time.Since(start), err)
 	// 处理过程出错，进入错误统一处理逻辑
 	if err != nil {
 		c.handleError(key, err)
@@ -166,91 +384,72 @@ func (c *controller) handleError(key string, err error) {
 
 	// 运行时统一处理错误
 	runtime.HandleError(err)
+	// 在service上记录Warning事件，让service的使用者知道路由对象为什么没有生成
+	if namespace, name, splitErr := cache.SplitMetaNamespaceKey(key); splitErr == nil {
+		if service, getErr := c.serviceLister.Services(namespace).Get(name); getErr == nil {
+			c.recorder.Eventf(service, corev1.EventTypeWarning, reasonSyncFailed, "Giving up after %d retries: %v", maxRetry, err)
+		}
+	}
 	// 不再处理这个key
 	c.queue.Forget(key)
 }
 
-// syncService 处理service逻辑的核心方法
-func (c *controller) syncService(key string) error {
+// syncService 处理service逻辑的核心方法，返回对路由对象做了什么操作
+func (c *controller) syncService(key string) (syncOutcome, error) {
 	// 将 key 切割为 ns 和 name
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
-		return err
+		return outcomeSkipped, err
 	}
 
 	// 从indexer中，获取service
 	service, err := c.serviceLister.Services(namespace).Get(name)
-	// 没有service，直接返回
-	if errors.IsNotFound(err) {
-		return nil
+	if err != nil && !errors.IsNotFound(err) {
+		return outcomeSkipped, err
 	}
-	if err != nil {
-		return err
+
+	// service已经被删除。独占的路由对象会由gc删除，共享的ingress需要移除这个service的path
+	if service == nil {
+		if c.opts.AggregateByHost {
+			return c.syncSharedIngresses(namespace, name, nil)
+		}
+		return outcomeSkipped, nil
 	}
 
 	// 检查service的annotation，是否包含 key: "ingress/http"
-	_, ok := service.Annotations[annoKey]
-	// 从indexer缓存中，获取ingress
-	ingress, err := c.ingressLister.Ingresses(namespace).Get(name)
-
-	if ok && errors.IsNotFound(err) {
-		// ingress不存在，但是service有"ingress/http"，需要创建ingress
-		// 创建ingress
-		ig := c.createIngress(service)
-		// 调用controller中的client，完成ingress的创建
-		_, err := c.client.NetworkingV1().Ingresses(namespace).Create(context.TODO(), ig, metav1.CreateOptions{})
+	if _, ok := service.Annotations[annoKey]; !ok {
+		// service没有"ingress/http"，删除所有后端中由service生成的路由对象，以及写回service的annotation
+		outcome, err := c.cleanupBackends(service, "")
 		if err != nil {
-			return err
-		}
-	} else if !ok && ingress != nil {
-		// ingress存在，但是service没有"ingress/http"，需要删除ingress
-		// 调用controller中的client，完成ingress的删除
-		err := c.client.NetworkingV1().Ingresses(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
-		if err != nil {
-			return err
+			return outcome, err
 		}
+		return outcome, c.clearServiceAnnotations(service)
 	}
 
-	return nil
-}
+	// 解析service上描述ingress的annotation，值不合法时记录Warning事件。重试无法修复annotation，所以不返回错误
+	opts, err := c.parseIngressOptions(service)
+	if err != nil {
+		c.recorder.Event(service, corev1.EventTypeWarning, reasonInvalidAnnotation, err.Error())
+		return outcomeSkipped, nil
+	}
 
-// createIngress 创建ingress
-func (c *controller) createIngress(service *corev1.Service) *netv1.Ingress {
-	icn := "ingress"
-	pathType := netv1.PathTypePrefix
-	return &netv1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      service.Name,
-			Namespace: service.Namespace,
-			OwnerReferences: []metav1.OwnerReference{
-				*metav1.NewControllerRef(service, corev1.SchemeGroupVersion.WithKind("Service")),
-			},
-		},
-		Spec: netv1.IngressSpec{
-			IngressClassName: &icn,
-			Rules: []netv1.IngressRule{
-				{
-					Host: "example.com",
-					IngressRuleValue: netv1.IngressRuleValue{
-						HTTP: &netv1.HTTPIngressRuleValue{
-							Paths: []netv1.HTTPIngressPath{
-								{
-									Path:     "/",
-									PathType: &pathType,
-									Backend: netv1.IngressBackend{
-										Service: &netv1.IngressServiceBackend{
-											Name: service.Name,
-											Port: netv1.ServiceBackendPort{
-												Number: 80,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+	// 选择生成路由对象的后端
+	backendName := c.backendName(opts)
+	backend, ok := c.backends[backendName]
+	if !ok {
+		c.recorder.Eventf(service, corev1.EventTypeWarning, reasonInvalidAnnotation, "route backend %q is not enabled", backendName)
+		return outcomeSkipped, nil
+	}
+	// service可能切换了后端，删除其它后端中由service生成的路由对象
+	outcome, err := c.cleanupBackends(service, backendName)
+	if err != nil {
+		return outcome, err
+	}
+	backendOutcome, err := backend.sync(service, opts)
+	outcome = outcome.merge(backendOutcome)
+	if err != nil || backendName == backendIngress {
+		return outcome, err
 	}
+	// HTTPRoute 没有负载均衡地址，也不检测路由冲突，删除之前由 ingress 写回service的annotation
+	return outcome, c.clearServiceAnnotations(service)
 }
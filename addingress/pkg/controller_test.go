@@ -0,0 +1,577 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	informercorev1 "k8s.io/client-go/informers/core/v1"
+	informernetv1 "k8s.io/client-go/informers/networking/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	listercorev1 "k8s.io/client-go/listers/core/v1"
+	listernetv1 "k8s.io/client-go/listers/networking/v1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// newQueueController 返回只有workqueue的控制器，用于测试事件处理函数
+func newQueueController() *controller {
+	return &controller{queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test")}
+}
+
+// ownedIngress 返回由 owner 控制的ingress
+func ownedIngress(owner *corev1.Service, resourceVersion string) *netv1.Ingress {
+	return &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            owner.Name,
+			Namespace:       owner.Namespace,
+			ResourceVersion: resourceVersion,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(owner, corev1.SchemeGroupVersion.WithKind("Service"))},
+		},
+	}
+}
+
+func ownerService() *corev1.Service {
+	return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault, UID: types.UID("test-uid")}}
+}
+
+// expectQueue 检查队列中的key，并清空队列
+func expectQueue(t *testing.T, c *controller, expected ...string) {
+	t.Helper()
+	var keys []string
+	for c.queue.Len() > 0 {
+		key, _ := c.queue.Get()
+		keys = append(keys, key.(string))
+		c.queue.Done(key)
+	}
+	if len(keys) != len(expected) {
+		t.Errorf("Expected keys %v in the queue, got %v", expected, keys)
+		return
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Errorf("Expected keys %v in the queue, got %v", expected, keys)
+			return
+		}
+	}
+}
+
+func TestUpdateIngressEnqueuesOwner(t *testing.T) {
+	c := newQueueController()
+	old := ownedIngress(ownerService(), "1")
+
+	// resync 时 resourceVersion 不变，不需要处理
+	c.updateIngress(old, old.DeepCopy())
+	expectQueue(t, c)
+
+	c.updateIngress(old, ownedIngress(ownerService(), "2"))
+	expectQueue(t, c, "default/test")
+
+	// 不是由service控制的ingress不需要处理
+	uncontrolled := ownedIngress(ownerService(), "3")
+	uncontrolled.OwnerReferences = nil
+	c.updateIngress(old, uncontrolled)
+	expectQueue(t, c)
+}
+
+func TestDeleteIngressEnqueuesOwner(t *testing.T) {
+	c := newQueueController()
+	ingress := ownedIngress(ownerService(), "1")
+
+	c.deleteIngress(ingress)
+	expectQueue(t, c, "default/test")
+
+	// informer错过了删除事件时，拿到的是 DeletedFinalStateUnknown
+	c.deleteIngress(cache.DeletedFinalStateUnknown{Key: "default/test", Obj: ingress})
+	expectQueue(t, c, "default/test")
+
+	// 不是ingress的 tombstone 会被忽略
+	c.deleteIngress(cache.DeletedFinalStateUnknown{Key: "default/test", Obj: ownerService()})
+	expectQueue(t, c)
+}
+
+func TestHandleErrorGivesUp(t *testing.T) {
+	c := newQueueController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	c.serviceLister = listercorev1.NewServiceLister(newIndexer(ownerService()))
+	key := "default/test"
+
+	c.handleError(key, fmt.Errorf("connection refused"))
+	if c.queue.NumRequeues(key) != 1 {
+		t.Errorf("Expected the key to be requeued, got %d requeues", c.queue.NumRequeues(key))
+	}
+	for c.queue.NumRequeues(key) < maxRetry {
+		c.queue.AddRateLimited(key)
+	}
+
+	// 重试次数耗尽后不再重试，在service上记录事件
+	c.handleError(key, fmt.Errorf("connection refused"))
+	if c.queue.NumRequeues(key) != 0 {
+		t.Errorf("Expected the key to be forgotten, got %d requeues", c.queue.NumRequeues(key))
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning "+reasonSyncFailed) {
+			t.Errorf("Expected event %s, got %q", reasonSyncFailed, event)
+		}
+	default:
+		t.Errorf("Expected event %s, got none", reasonSyncFailed)
+	}
+}
+
+func TestHasSynced(t *testing.T) {
+	c := newQueueController()
+	synced := false
+	c.synced = []cache.InformerSynced{
+		func() bool { return true },
+		func() bool { return synced },
+	}
+	// 所有informer都同步完成后才就绪
+	if c.HasSynced() {
+		t.Errorf("Expected controller not to be ready before every informer synced")
+	}
+	synced = true
+	if !c.HasSynced() {
+		t.Errorf("Expected controller to be ready after every informer synced")
+	}
+}
+
+// blockingServiceLister 第一次查询service时阻塞，直到 release 被关闭，用来模拟正在处理中的key
+type blockingServiceLister struct {
+	listercorev1.ServiceLister
+	once    *sync.Once
+	started chan struct{}
+	release chan struct{}
+	calls   *int32
+}
+
+func (l blockingServiceLister) Services(namespace string) listercorev1.ServiceNamespaceLister {
+	atomic.AddInt32(l.calls, 1)
+	l.once.Do(func() {
+		close(l.started)
+		<-l.release
+	})
+	return l.ServiceLister.Services(namespace)
+}
+
+func TestRunDrainsQueue(t *testing.T) {
+	c := newQueueController()
+	lister := blockingServiceLister{
+		ServiceLister: listercorev1.NewServiceLister(newIndexer()),
+		once:          &sync.Once{},
+		started:       make(chan struct{}),
+		release:       make(chan struct{}),
+		calls:         new(int32),
+	}
+	c.serviceLister = lister
+	c.ingressLister = listernetv1.NewIngressLister(newIndexer())
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.Run(stopCh)
+		close(done)
+	}()
+	c.queue.Add("default/a")
+	<-lister.started
+	c.queue.Add("default/b")
+	c.queue.Add("default/c")
+
+	// 收到停止信号后，Run 要等正在处理的key完成才能返回
+	close(stopCh)
+	select {
+	case <-done:
+		t.Fatal("Run returned while a key was still being processed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(lister.release)
+	select {
+	case <-done:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Run did not return after the queue was drained")
+	}
+
+	if c.queue.Len() != 0 {
+		t.Errorf("Expected the queue to be drained, got %d keys", c.queue.Len())
+	}
+	if calls := atomic.LoadInt32(lister.calls); calls != 3 {
+		t.Errorf("Expected 3 keys to be processed, got %d", calls)
+	}
+}
+
+var (
+	noResyncPeriodFunc = func() time.Duration { return 0 }
+	ingressResource    = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+)
+
+type fixture struct {
+	t *testing.T
+
+	client *fake.Clientset
+	// Objects to put in the store.
+	serviceLister []*corev1.Service
+	ingressLister []*netv1.Ingress
+	// Actions expected to happen on the client.
+	actions []core.Action
+	// Objects from here preloaded into NewSimpleClientset.
+	objects []runtime.Object
+	// applyErrors are returned, in order, by server-side apply patches of ingresses.
+	applyErrors []error
+
+	recorder *record.FakeRecorder
+	// opts 创建控制器时使用的参数
+	opts Options
+}
+
+func newFixture(t *testing.T) *fixture {
+	f := &fixture{}
+	f.t = t
+	f.objects = []runtime.Object{}
+	return f
+}
+
+func newService(name string, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   metav1.NamespaceDefault,
+			UID:         types.UID(name + "-uid"),
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 8080}},
+		},
+	}
+}
+
+func (f *fixture) newController() (*controller, informers.SharedInformerFactory) {
+	f.client = fake.NewSimpleClientset(f.objects...)
+	// 控制器以 server-side apply 写入ingress，fake clientset 不支持 apply patch，由这里模拟 apiserver 的响应
+	f.client.PrependReactor("patch", "ingresses", func(action core.Action) (bool, runtime.Object, error) {
+		patch := action.(core.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		if len(f.applyErrors) != 0 {
+			err := f.applyErrors[0]
+			f.applyErrors = f.applyErrors[1:]
+			if err != nil {
+				return true, nil, err
+			}
+		}
+		ingress := &netv1.Ingress{}
+		if err := json.Unmarshal(patch.GetPatch(), ingress); err != nil {
+			return true, nil, err
+		}
+		return true, ingress, nil
+	})
+
+	i := informers.NewSharedInformerFactory(f.client, noResyncPeriodFunc())
+
+	c := NewController(f.client,
+		[]informercorev1.ServiceInformer{i.Core().V1().Services()},
+		[]informernetv1.IngressInformer{i.Networking().V1().Ingresses()},
+		f.opts)
+
+	f.recorder = record.NewFakeRecorder(10)
+	c.recorder = f.recorder
+
+	for _, s := range f.serviceLister {
+		i.Core().V1().Services().Informer().GetIndexer().Add(s)
+	}
+	for _, ing := range f.ingressLister {
+		i.Networking().V1().Ingresses().Informer().GetIndexer().Add(ing)
+	}
+
+	return c, i
+}
+
+func (f *fixture) run(key string) {
+	f.runController(key, false)
+}
+
+func (f *fixture) runExpectError(key string) {
+	f.runController(key, true)
+}
+
+func (f *fixture) runController(key string, expectError bool) {
+	c, _ := f.newController()
+	f.syncService(c, key, expectError)
+}
+
+// syncService 用已经创建的控制器处理key，并检查client上的请求
+func (f *fixture) syncService(c *controller, key string, expectError bool) {
+	_, err := c.syncService(key)
+	if !expectError && err != nil {
+		f.t.Errorf("error syncing service: %v", err)
+	} else if expectError && err == nil {
+		f.t.Error("expected error syncing service, got nil")
+	}
+
+	actions := filterInformerActions(f.client.Actions())
+	for i, action := range actions {
+		if len(f.actions) < i+1 {
+			f.t.Errorf("%d unexpected actions: %+v", len(actions)-len(f.actions), actions[i:])
+			break
+		}
+
+		expectedAction := f.actions[i]
+		checkAction(expectedAction, action, f.t)
+	}
+
+	if len(f.actions) > len(actions) {
+		f.t.Errorf("%d additional expected actions:%+v", len(f.actions)-len(actions), f.actions[len(actions):])
+	}
+}
+
+// checkAction verifies that expected and actual actions are equal and both have
+// same attached resources
+func checkAction(expected, actual core.Action, t *testing.T) {
+	if !(expected.Matches(actual.GetVerb(), actual.GetResource().Resource) && actual.GetSubresource() == expected.GetSubresource()) {
+		t.Errorf("Expected\n\t%#v\ngot\n\t%#v", expected, actual)
+		return
+	}
+
+	if reflect.TypeOf(actual) != reflect.TypeOf(expected) {
+		t.Errorf("Action has wrong type. Expected: %t. Got: %t", expected, actual)
+		return
+	}
+
+	switch a := actual.(type) {
+	case core.PatchActionImpl:
+		e, _ := expected.(core.PatchActionImpl)
+		if e.GetName() != a.GetName() || e.GetPatchType() != a.GetPatchType() {
+			t.Errorf("Action %s %s has wrong name or patch type. Expected: %s %s. Got: %s %s",
+				a.GetVerb(), a.GetResource().Resource, e.GetName(), e.GetPatchType(), a.GetName(), a.GetPatchType())
+		}
+		if e.GetPatchType() == types.ApplyPatchType {
+			expObject, object := &netv1.Ingress{}, &netv1.Ingress{}
+			json.Unmarshal(e.GetPatch(), expObject)
+			json.Unmarshal(a.GetPatch(), object)
+			if !reflect.DeepEqual(expObject, object) {
+				t.Errorf("Action %s %s has wrong patch\nDiff:\n %s",
+					a.GetVerb(), a.GetResource().Resource, diff.ObjectGoPrintSideBySide(expObject, object))
+			}
+		}
+	case core.DeleteActionImpl:
+		e, _ := expected.(core.DeleteActionImpl)
+		if e.GetName() != a.GetName() {
+			t.Errorf("Action %s %s has wrong name. Expected: %s. Got: %s",
+				a.GetVerb(), a.GetResource().Resource, e.GetName(), a.GetName())
+		}
+	default:
+		t.Errorf("Uncaptured Action %s %s, you should explicitly add a case to capture it",
+			actual.GetVerb(), actual.GetResource().Resource)
+	}
+}
+
+// filterInformerActions filters list and watch actions for testing resources.
+// Since list and watch don't change resource state we can filter it to lower
+// nose level in our tests.
+func filterInformerActions(actions []core.Action) []core.Action {
+	ret := []core.Action{}
+	for _, action := range actions {
+		if len(action.GetNamespace()) == 0 &&
+			(action.Matches("list", "services") ||
+				action.Matches("watch", "services") ||
+				action.Matches("list", "ingresses") ||
+				action.Matches("watch", "ingresses")) {
+			continue
+		}
+		ret = append(ret, action)
+	}
+
+	return ret
+}
+
+func (f *fixture) expectApplyIngressAction(ingress *netv1.Ingress) {
+	patch, err := json.Marshal(ingressApplyConfiguration(ingress))
+	if err != nil {
+		f.t.Fatalf("failed to marshal apply configuration: %v", err)
+	}
+	f.actions = append(f.actions, core.NewPatchAction(ingressResource, ingress.Namespace, ingress.Name, types.ApplyPatchType, patch))
+}
+
+func (f *fixture) expectDeleteIngressAction(ingress *netv1.Ingress) {
+	f.actions = append(f.actions, core.NewDeleteAction(ingressResource, ingress.Namespace, ingress.Name))
+}
+
+// expectEvent 检查记录的下一个事件以 prefix 开头，比如 "Normal Created"
+func (f *fixture) expectEvent(prefix string) {
+	select {
+	case event := <-f.recorder.Events:
+		if !strings.HasPrefix(event, prefix) {
+			f.t.Errorf("Expected event %q, got %q", prefix, event)
+		}
+	default:
+		f.t.Errorf("Expected event %q, got none", prefix)
+	}
+}
+
+func getKey(service *corev1.Service, t *testing.T) string {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(service)
+	if err != nil {
+		t.Errorf("Unexpected error getting key for service %v: %v", service.Name, err)
+		return ""
+	}
+	return key
+}
+
+// desiredIngress 返回控制器为service生成的ingress
+func desiredIngress(t *testing.T, c *controller, service *corev1.Service) *netv1.Ingress {
+	opts, err := c.parseIngressOptions(service)
+	if err != nil {
+		t.Fatalf("failed to parse annotations of service %s: %v", service.Name, err)
+	}
+	return c.createIngress(service, opts)
+}
+
+func TestCreatesIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("test", map[string]string{annoKey: "true", annoHost: "test.example.com"})
+
+	f.serviceLister = append(f.serviceLister, service)
+	f.objects = append(f.objects, service)
+
+	c, _ := f.newController()
+	ingress := desiredIngress(t, c, service)
+	if got := ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port.Number; got != 8080 {
+		t.Errorf("Expected backend port 8080 from the service spec, got %d", got)
+	}
+	f.expectApplyIngressAction(ingress)
+
+	f.run(getKey(service, t))
+	f.expectEvent("Normal " + reasonCreated)
+}
+
+func TestDoNothing(t *testing.T) {
+	f := newFixture(t)
+	service := newService("test", nil)
+
+	f.serviceLister = append(f.serviceLister, service)
+	f.objects = append(f.objects, service)
+
+	f.run(getKey(service, t))
+}
+
+func TestDeletesIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("test", nil)
+	c, _ := f.newController()
+	ingress := desiredIngress(t, c, service)
+
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, ingress)
+	f.objects = append(f.objects, service, ingress)
+
+	f.expectDeleteIngressAction(ingress)
+
+	f.run(getKey(service, t))
+	f.expectEvent("Normal " + reasonDeleted)
+}
+
+func TestDoesNotDeleteUncontrolledIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("test", nil)
+	c, _ := f.newController()
+	ingress := desiredIngress(t, c, service)
+	ingress.OwnerReferences = nil
+
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, ingress)
+	f.objects = append(f.objects, service, ingress)
+
+	f.run(getKey(service, t))
+}
+
+func TestDoesNotOverwriteConflictingFields(t *testing.T) {
+	f := newFixture(t)
+	service := newService("test", map[string]string{annoKey: "true"})
+	c, _ := f.newController()
+	ingress := desiredIngress(t, c, service)
+
+	f.serviceLister = append(f.serviceLister, service)
+	f.objects = append(f.objects, service)
+	// apply 与其它 field manager 冲突，没有设置 --force-conflicts 时不强制接管，也不重试
+	f.applyErrors = []error{errors.NewConflict(netv1.Resource("ingresses"), ingress.Name, nil)}
+
+	f.expectApplyIngressAction(ingress)
+
+	f.run(getKey(service, t))
+	f.expectEvent("Warning " + reasonFieldConflict)
+}
+
+func TestForceConflictsReturnsErrorOnConflict(t *testing.T) {
+	f := newFixture(t)
+	f.opts.ForceConflicts = true
+	service := newService("test", map[string]string{annoKey: "true"})
+	c, _ := f.newController()
+	ingress := desiredIngress(t, c, service)
+
+	f.serviceLister = append(f.serviceLister, service)
+	f.objects = append(f.objects, service)
+	// 强制 apply 仍然冲突时返回错误，稍后重试
+	f.applyErrors = []error{errors.NewConflict(netv1.Resource("ingresses"), ingress.Name, nil)}
+
+	f.expectApplyIngressAction(ingress)
+
+	f.runExpectError(getKey(service, t))
+	f.expectEvent("Warning " + reasonConflict)
+}
+
+func TestInvalidAnnotationRecordsEvent(t *testing.T) {
+	f := newFixture(t)
+	service := newService("test", map[string]string{annoKey: "true", annoPort: "grpc"})
+
+	f.serviceLister = append(f.serviceLister, service)
+	f.objects = append(f.objects, service)
+
+	f.run(getKey(service, t))
+	f.expectEvent("Warning " + reasonInvalidAnnotation)
+}
+
+func TestDeleteServiceTombstone(t *testing.T) {
+	f := newFixture(t)
+	f.opts.AggregateByHost = true
+	service := newService("test", map[string]string{annoKey: "true"})
+	opts, err := parseOptions(service)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ingress := createSharedIngress(service.Namespace, opts.host, []sharedMember{{service: service, opts: opts}})
+
+	// service已经被删除，共享ingress中只剩下这个service
+	f.ingressLister = append(f.ingressLister, ingress)
+	f.objects = append(f.objects, ingress)
+	c, _ := f.newController()
+
+	// informer错过了删除事件时，拿到的是 DeletedFinalStateUnknown
+	c.deleteService(cache.DeletedFinalStateUnknown{Key: getKey(service, t), Obj: service})
+	if c.queue.Len() != 1 {
+		t.Fatalf("Expected 1 key in the queue, got %d", c.queue.Len())
+	}
+	key, _ := c.queue.Get()
+	defer c.queue.Done(key)
+
+	f.expectDeleteIngressAction(ingress)
+	f.syncService(c, key.(string), false)
+}
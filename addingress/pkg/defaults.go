@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	informercorev1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"sync"
+)
+
+// DefaultsConfigMapName 提供默认值的 ConfigMap 的名称。
+// 每个namespace中都可以有一个，为这个namespace中的service提供默认值；
+// --defaults-namespace 中的这个 ConfigMap 为所有service提供默认值，namespace中的 ConfigMap 设置了的key优先。
+// 默认值的优先级低于service上的annotation
+const DefaultsConfigMapName = "addingress-defaults"
+
+// 默认值 ConfigMap 中的key：
+//
+//	ingress-class   默认的 ingressClassName
+//	host-suffix     service 没有设置 ingress/host 时，host 为 <service名称>.<host-suffix>。
+//	                设置了 host-suffix 的namespace（包括全局 ConfigMap 设置时的所有namespace）不再使用 --host-template
+//	tls             为 true 时默认开启TLS
+//	cluster-issuer  开启TLS时默认使用的 cert-manager ClusterIssuer
+//	issuer          开启TLS时默认使用的 cert-manager Issuer，与 cluster-issuer 只能设置一个
+const (
+	defaultsKeyIngressClass  = "ingress-class"
+	defaultsKeyHostSuffix    = "host-suffix"
+	defaultsKeyTLS           = "tls"
+	defaultsKeyClusterIssuer = "cluster-issuer"
+	defaultsKeyIssuer        = "issuer"
+)
+
+// 默认值 ConfigMap 中的值不合法，事件记录在 ConfigMap 上
+const reasonInvalidDefaults = "InvalidDefaults"
+
+// defaultsCache 按namespace缓存默认值 ConfigMap 中校验通过的key，ConfigMap 的 resourceVersion 变化后重新校验
+type defaultsCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedDefaults
+}
+
+// cachedDefaults 一个 ConfigMap 中校验通过的key和值
+type cachedDefaults struct {
+	resourceVersion string
+	data            map[string]string
+}
+
+// invalidDefault 默认值 ConfigMap 中不合法的key
+type invalidDefault struct {
+	key, value, msg string
+}
+
+// ingressDefaults 从 ConfigMap 中读取的默认值，空值表示没有设置
+type ingressDefaults struct {
+	ingressClass  string
+	hostSuffix    string
+	tls           bool
+	clusterIssuer string
+	issuer        string
+}
+
+// EnableDefaults 启用默认值 ConfigMap。configMapInformers 只需要缓存名为 DefaultsConfigMapName 的 ConfigMap，
+// 需要覆盖所有监听的namespace，以及 globalNamespace。globalNamespace 为空时没有全局的默认值。
+// 需要在 Run 之前调用，并由调用方启动 configMapInformers、等待其完成同步
+func (c *controller) EnableDefaults(configMapInformers []informercorev1.ConfigMapInformer, globalNamespace string) {
+	var configMapLister multiConfigMapLister
+	for _, configMapInformer := range configMapInformers {
+		// ConfigMap 变化后，校验新的默认值，受影响的service重新调谐
+		configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: c.addDefaults,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				// resourceVersion 相同，说明是informer的定期resync，ConfigMap 并没有变化
+				if oldObj.(*corev1.ConfigMap).ResourceVersion == newObj.(*corev1.ConfigMap).ResourceVersion {
+					return
+				}
+				c.addDefaults(newObj)
+			},
+			DeleteFunc: c.deleteDefaults,
+		})
+		configMapLister = append(configMapLister, configMapInformer.Lister())
+		c.synced = append(c.synced, configMapInformer.Informer().HasSynced)
+	}
+	c.configMapLister = configMapLister
+	c.globalNamespace = globalNamespace
+	c.defaultsCache = &defaultsCache{entries: map[string]cachedDefaults{}}
+}
+
+// addDefaults 添加或修改默认值 ConfigMap 时触发。每个版本的 ConfigMap 只校验一次，不合法的值在 ConfigMap 上记录Warning事件
+func (c *controller) addDefaults(obj interface{}) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok || configMap.Name != DefaultsConfigMapName {
+		return
+	}
+	for _, invalid := range c.cacheDefaults(configMap) {
+		c.recorder.Eventf(configMap, corev1.EventTypeWarning, reasonInvalidDefaults, "invalid %s=%q: %s", invalid.key, invalid.value, invalid.msg)
+	}
+	c.enqueueDefaultsChange(obj)
+}
+
+// deleteDefaults 删除默认值 ConfigMap 时触发
+func (c *controller) deleteDefaults(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if namespace, name, err := cache.SplitMetaNamespaceKey(key); err == nil && name == DefaultsConfigMapName {
+		c.defaultsCache.mu.Lock()
+		delete(c.defaultsCache.entries, namespace)
+		c.defaultsCache.mu.Unlock()
+	}
+	c.enqueueDefaultsChange(obj)
+}
+
+// enqueueDefaultsChange 默认值 ConfigMap 变化时，将受影响的service加入workqueue：
+// 全局的 ConfigMap 影响所有service，namespace中的 ConfigMap 只影响这个namespace中的service
+func (c *controller) enqueueDefaultsChange(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil || name != DefaultsConfigMapName {
+		return
+	}
+
+	var services []*corev1.Service
+	if namespace == c.globalNamespace {
+		services, err = c.serviceLister.List(labels.Everything())
+	} else {
+		services, err = c.serviceLister.Services(namespace).List(labels.Everything())
+	}
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, service := range services {
+		c.enqueue(service)
+	}
+}
+
+// ingressDefaults 返回namespace中service使用的默认值，namespace中的 ConfigMap 覆盖全局的 ConfigMap
+func (c *controller) ingressDefaults(namespace string) ingressDefaults {
+	var defaults ingressDefaults
+	if c.configMapLister == nil {
+		return defaults
+	}
+	if c.globalNamespace != "" {
+		c.readDefaults(c.globalNamespace, &defaults)
+	}
+	if namespace != c.globalNamespace {
+		c.readDefaults(namespace, &defaults)
+	}
+	return defaults
+}
+
+// readDefaults 读取namespace中的默认值 ConfigMap，用其中设置了的key覆盖 defaults。
+// 不合法的值会被忽略。这里不记录事件，可以在 webhook 等没有副作用的地方调用
+func (c *controller) readDefaults(namespace string, defaults *ingressDefaults) {
+	configMap, err := c.configMapLister.ConfigMaps(namespace).Get(DefaultsConfigMapName)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			runtime.HandleError(err)
+		}
+		return
+	}
+	c.defaultsCache.mu.Lock()
+	cached, ok := c.defaultsCache.entries[namespace]
+	c.defaultsCache.mu.Unlock()
+	data := cached.data
+	// informer 的事件处理可能晚于缓存同步，还没有校验过这个版本的 ConfigMap 时在这里校验，事件由 addDefaults 记录
+	if !ok || cached.resourceVersion != configMap.ResourceVersion {
+		data, _ = parseDefaults(configMap)
+	}
+
+	if value, ok := data[defaultsKeyIngressClass]; ok {
+		defaults.ingressClass = value
+	}
+	if value, ok := data[defaultsKeyHostSuffix]; ok {
+		defaults.hostSuffix = value
+	}
+	if value, ok := data[defaultsKeyTLS]; ok {
+		defaults.tls, _ = strconv.ParseBool(value)
+	}
+	// 只能使用一种 issuer，namespace中设置的 issuer 覆盖全局的 cluster-issuer，反之亦然
+	if value, ok := data[defaultsKeyClusterIssuer]; ok {
+		defaults.clusterIssuer, defaults.issuer = value, ""
+	}
+	if value, ok := data[defaultsKeyIssuer]; ok {
+		defaults.clusterIssuer, defaults.issuer = "", value
+	}
+}
+
+// cacheDefaults 校验 ConfigMap 并缓存其中合法的key，返回不合法的key
+func (c *controller) cacheDefaults(configMap *corev1.ConfigMap) []invalidDefault {
+	data, invalid := parseDefaults(configMap)
+	c.defaultsCache.mu.Lock()
+	defer c.defaultsCache.mu.Unlock()
+	c.defaultsCache.entries[configMap.Namespace] = cachedDefaults{resourceVersion: configMap.ResourceVersion, data: data}
+	return invalid
+}
+
+// parseDefaults 校验默认值 ConfigMap，返回其中合法的key和值，以及不合法的key
+func parseDefaults(configMap *corev1.ConfigMap) (map[string]string, []invalidDefault) {
+	data := map[string]string{}
+	var invalid []invalidDefault
+	for _, key := range []string{defaultsKeyIngressClass, defaultsKeyHostSuffix} {
+		if value, ok := configMap.Data[key]; ok {
+			if msgs := validation.IsDNS1123Subdomain(value); len(msgs) != 0 {
+				invalid = append(invalid, invalidDefault{key, value, messagesError(msgs).Error()})
+			} else {
+				data[key] = value
+			}
+		}
+	}
+	if value, ok := configMap.Data[defaultsKeyTLS]; ok {
+		if _, err := strconv.ParseBool(value); err != nil {
+			invalid = append(invalid, invalidDefault{defaultsKeyTLS, value, "must be true or false"})
+		} else {
+			data[defaultsKeyTLS] = value
+		}
+	}
+
+	clusterIssuer, hasClusterIssuer := configMap.Data[defaultsKeyClusterIssuer]
+	issuer, hasIssuer := configMap.Data[defaultsKeyIssuer]
+	switch {
+	case hasClusterIssuer && hasIssuer:
+		invalid = append(invalid, invalidDefault{defaultsKeyIssuer, issuer, fmt.Sprintf("mutually exclusive with %s", defaultsKeyClusterIssuer)})
+	case hasClusterIssuer:
+		if msgs := validation.IsDNS1123Subdomain(clusterIssuer); len(msgs) != 0 {
+			invalid = append(invalid, invalidDefault{defaultsKeyClusterIssuer, clusterIssuer, messagesError(msgs).Error()})
+		} else {
+			data[defaultsKeyClusterIssuer] = clusterIssuer
+		}
+	case hasIssuer:
+		if msgs := validation.IsDNS1123Subdomain(issuer); len(msgs) != 0 {
+			invalid = append(invalid, invalidDefault{defaultsKeyIssuer, issuer, messagesError(msgs).Error()})
+		} else {
+			data[defaultsKeyIssuer] = issuer
+		}
+	}
+	return data, invalid
+}
@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	informercorev1 "k8s.io/client-go/informers/core/v1"
+	listercorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// defaultsConfigMap 返回namespace中的默认值 ConfigMap
+func defaultsConfigMap(namespace string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultsConfigMapName, Namespace: namespace},
+		Data:       data,
+	}
+}
+
+// newDefaultsController 返回启用了默认值 ConfigMap 的控制器，全局的默认值在 addingress-system 中
+func newDefaultsController(objs ...interface{}) (*controller, *record.FakeRecorder) {
+	recorder := record.NewFakeRecorder(10)
+	c := newQueueController()
+	c.recorder = recorder
+	c.configMapLister = multiConfigMapLister{listercorev1.NewConfigMapLister(newIndexer(objs...))}
+	c.globalNamespace = "addingress-system"
+	c.defaultsCache = &defaultsCache{entries: map[string]cachedDefaults{}}
+	return c, recorder
+}
+
+func TestIngressDefaults(t *testing.T) {
+	c, recorder := newDefaultsController(
+		defaultsConfigMap("addingress-system", map[string]string{
+			defaultsKeyIngressClass:  "nginx",
+			defaultsKeyHostSuffix:    "apps.example.com",
+			defaultsKeyTLS:           "true",
+			defaultsKeyClusterIssuer: "letsencrypt",
+		}),
+		defaultsConfigMap("team-a", map[string]string{
+			defaultsKeyHostSuffix: "team-a.example.com",
+			defaultsKeyIssuer:     "local",
+		}),
+		defaultsConfigMap("team-b", map[string]string{
+			defaultsKeyTLS: "yes",
+		}),
+	)
+
+	tests := []struct {
+		namespace string
+		expected  ingressDefaults
+	}{
+		{
+			namespace: "default",
+			expected:  ingressDefaults{ingressClass: "nginx", hostSuffix: "apps.example.com", tls: true, clusterIssuer: "letsencrypt"},
+		},
+		{
+			// namespace中设置的 issuer 覆盖全局的 cluster-issuer
+			namespace: "team-a",
+			expected:  ingressDefaults{ingressClass: "nginx", hostSuffix: "team-a.example.com", tls: true, issuer: "local"},
+		},
+		{
+			// 不合法的值被忽略，使用全局的默认值
+			namespace: "team-b",
+			expected:  ingressDefaults{ingressClass: "nginx", hostSuffix: "apps.example.com", tls: true, clusterIssuer: "letsencrypt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.namespace, func(t *testing.T) {
+			if defaults := c.ingressDefaults(test.namespace); !reflect.DeepEqual(defaults, test.expected) {
+				t.Errorf("Expected defaults %+v, got %+v", test.expected, defaults)
+			}
+		})
+	}
+
+	// 读取默认值时不记录事件，不合法的值由 addDefaults 记录
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("Expected no events, got %q", event)
+	default:
+	}
+}
+
+func TestParseIngressOptionsDefaults(t *testing.T) {
+	c, _ := newDefaultsController(defaultsConfigMap("addingress-system", map[string]string{
+		defaultsKeyIngressClass:  "nginx",
+		defaultsKeyHostSuffix:    "apps.example.com",
+		defaultsKeyTLS:           "true",
+		defaultsKeyClusterIssuer: "letsencrypt",
+	}))
+
+	opts, err := c.parseIngressOptions(annotatedService(map[string]string{annoKey: "true"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.host != "test.apps.example.com" || opts.ingressClassName != "nginx" || !opts.tls || opts.clusterIssuer != "letsencrypt" {
+		t.Errorf("Expected options from the defaults, got %+v", opts)
+	}
+
+	// annotation 优先于默认值
+	opts, err = c.parseIngressOptions(annotatedService(map[string]string{annoKey: "true", annoClass: "traefik", annoTLS: "false"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.ingressClassName != "traefik" || opts.tls || opts.clusterIssuer != "" {
+		t.Errorf("Expected options from the annotations, got %+v", opts)
+	}
+}
+
+func TestEnqueueDefaultsChange(t *testing.T) {
+	service := func(namespace string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: namespace}}
+	}
+	c, _ := newDefaultsController()
+	c.serviceLister = listercorev1.NewServiceLister(newIndexer(service("team-a"), service("team-b")))
+
+	c.enqueueDefaultsChange(defaultsConfigMap("team-a", nil))
+	expectQueue(t, c, "team-a/test")
+
+	// 全局的 ConfigMap 影响所有service
+	c.enqueueDefaultsChange(defaultsConfigMap("addingress-system", nil))
+	if c.queue.Len() != 2 {
+		t.Errorf("Expected every service to be enqueued, got %d keys", c.queue.Len())
+	}
+
+	c.queue = newQueueController().queue
+	other := defaultsConfigMap("team-a", nil)
+	other.Name = "other"
+	c.enqueueDefaultsChange(other)
+	expectQueue(t, c)
+}
+
+func TestInvalidDefaultsRecordedOnce(t *testing.T) {
+	f := newFixture(t)
+	c, i := f.newController()
+	c.EnableDefaults([]informercorev1.ConfigMapInformer{i.Core().V1().ConfigMaps()}, "")
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultsConfigMapName, Namespace: metav1.NamespaceDefault, ResourceVersion: "1"},
+		Data:       map[string]string{defaultsKeyHostSuffix: "apps.example.com", defaultsKeyTLS: "yes"},
+	}
+	i.Core().V1().ConfigMaps().Informer().GetIndexer().Add(configMap)
+
+	c.addDefaults(configMap)
+	f.expectEvent("Warning " + reasonInvalidDefaults)
+	for n := 0; n < 2; n++ {
+		defaults := c.ingressDefaults(metav1.NamespaceDefault)
+		if defaults.hostSuffix != "apps.example.com" || defaults.tls {
+			t.Errorf("Expected host suffix apps.example.com without TLS, got %+v", defaults)
+		}
+	}
+	select {
+	case event := <-f.recorder.Events:
+		t.Errorf("Expected no more events, got %q", event)
+	default:
+	}
+}
@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	netv1ac "k8s.io/client-go/applyconfigurations/networking/v1"
+	"k8s.io/client-go/dynamic"
+	typednetv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sort"
+	"sync"
+)
+
+// dry-run 模式下，控制器照常监听和调谐，但不会写入路由对象，只记录计划中的修改。
+// 写操作通过 ingresses、routes 两个方法返回的客户端发出，dry-run 模式下替换成只记录、不写入的客户端
+
+// plannedChange dry-run 模式下，一次计划中的创建、更新或删除
+type plannedChange struct {
+	action    syncOutcome
+	kind      string
+	namespace string
+	name      string
+	// diff 路由对象当前内容与期望内容的差异，只比较 metadata 中的 labels、annotations、ownerReferences，以及 spec
+	diff string
+}
+
+// dryRunPlan 记录 dry-run 模式下计划中的修改，多个worker并发写入。
+// 按 kind/namespace/name 记录，同一个对象只保留最后一次计划的修改：持续运行时 resync 不会让记录无限增长，
+// 共享ingress被每个成员service重复计划时也只报告一次
+type dryRunPlan struct {
+	mu      sync.Mutex
+	changes map[string]plannedChange
+}
+
+// plan 记录一次计划中的修改，并输出结构化日志。old 为 nil 表示创建，desired 为 nil 表示删除
+func (c *controller) plan(action syncOutcome, kind, namespace, name string, old, desired interface{}) {
+	diff := cmp.Diff(diffView(old), diffView(desired))
+	klog.InfoS("Dry run: planned change", "action", action, "kind", kind, "object", klog.KRef(namespace, name), "diff", diff)
+
+	c.dryRun.mu.Lock()
+	defer c.dryRun.mu.Unlock()
+	c.dryRun.changes[kind+"/"+namespace+"/"+name] = plannedChange{
+		action:    action,
+		kind:      kind,
+		namespace: namespace,
+		name:      name,
+		diff:      diff,
+	}
+}
+
+// diffView 取出路由对象中由控制器管理的字段，忽略 status、resourceVersion 等由apiserver维护的字段
+func diffView(obj interface{}) map[string]interface{} {
+	if obj == nil {
+		return nil
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	view := map[string]interface{}{}
+	for _, field := range []string{"labels", "annotations", "ownerReferences"} {
+		if value, ok, _ := unstructured.NestedFieldNoCopy(content, "metadata", field); ok {
+			view[field] = value
+		}
+	}
+	if spec, ok := content["spec"]; ok {
+		view["spec"] = spec
+	}
+	return view
+}
+
+// Report dry-run 模式下，对缓存中所有的service调谐一次，将计划中的修改写到 w。
+// 需要在informer同步完成之后、Run 之前调用
+func (c *controller) Report(w io.Writer) error {
+	if c.dryRun == nil {
+		return fmt.Errorf("report requires dry-run mode")
+	}
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, service := range services {
+		key, err := cache.MetaNamespaceKeyFunc(service)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := c.syncService(key); err != nil {
+			fmt.Fprintf(w, "error syncing service %s: %v\n", key, err)
+		}
+	}
+
+	c.dryRun.mu.Lock()
+	defer c.dryRun.mu.Unlock()
+	changeKeys := make([]string, 0, len(c.dryRun.changes))
+	for key := range c.dryRun.changes {
+		changeKeys = append(changeKeys, key)
+	}
+	sort.Strings(changeKeys)
+	counts := map[syncOutcome]int{}
+	for _, key := range changeKeys {
+		change := c.dryRun.changes[key]
+		counts[change.action]++
+		fmt.Fprintf(w, "%s %s %s/%s\n", change.action, change.kind, change.namespace, change.name)
+		if change.diff != "" {
+			fmt.Fprintln(w, change.diff)
+		}
+	}
+	fmt.Fprintf(w, "%d services, %d to create, %d to update, %d to delete\n",
+		len(keys), counts[outcomeCreated], counts[outcomeUpdated], counts[outcomeDeleted])
+	return nil
+}
+
+// ingresses 返回写 ingress 使用的客户端，dry-run 模式下只记录计划中的修改
+func (c *controller) ingresses(namespace string) typednetv1.IngressInterface {
+	ingresses := c.client.NetworkingV1().Ingresses(namespace)
+	if c.dryRun == nil {
+		return ingresses
+	}
+	return &dryRunIngresses{IngressInterface: ingresses, controller: c, namespace: namespace}
+}
+
+// dryRunIngresses 读操作使用真实的客户端，写操作只记录计划中的修改
+type dryRunIngresses struct {
+	typednetv1.IngressInterface
+	controller *controller
+	namespace  string
+}
+
+// Apply 比较控制器在缓存中的ingress上拥有的字段与期望的字段
+func (d *dryRunIngresses) Apply(ctx context.Context, ingress *netv1ac.IngressApplyConfiguration, opts metav1.ApplyOptions) (*netv1.Ingress, error) {
+	action := outcomeCreated
+	var old interface{}
+	if current, err := d.controller.ingressLister.Ingresses(d.namespace).Get(*ingress.Name); err == nil {
+		action = outcomeUpdated
+		if old, err = netv1ac.ExtractIngress(current, fieldManager); err != nil {
+			return nil, err
+		}
+	}
+	d.controller.plan(action, "Ingress", d.namespace, *ingress.Name, old, ingress)
+	return &netv1.Ingress{}, nil
+}
+
+func (d *dryRunIngresses) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	var old runtime.Object
+	if current, err := d.controller.ingressLister.Ingresses(d.namespace).Get(name); err == nil {
+		old = current
+	}
+	d.controller.plan(outcomeDeleted, "Ingress", d.namespace, name, old, nil)
+	return nil
+}
+
+// routes 返回写 HTTPRoute 使用的客户端，dry-run 模式下只记录计划中的修改
+func (b *httpRouteBackend) routes(namespace string) dynamic.ResourceInterface {
+	routes := b.dynamicClient.Resource(HTTPRouteResource).Namespace(namespace)
+	if b.dryRun == nil {
+		return routes
+	}
+	return &dryRunRoutes{ResourceInterface: routes, backend: b, namespace: namespace}
+}
+
+// dryRunRoutes 读操作使用真实的客户端，写操作只记录计划中的修改
+type dryRunRoutes struct {
+	dynamic.ResourceInterface
+	backend   *httpRouteBackend
+	namespace string
+}
+
+func (d *dryRunRoutes) Create(ctx context.Context, route *unstructured.Unstructured, opts metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	d.backend.plan(outcomeCreated, "HTTPRoute", d.namespace, route.GetName(), nil, route)
+	return route, nil
+}
+
+func (d *dryRunRoutes) Update(ctx context.Context, route *unstructured.Unstructured, opts metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	var old runtime.Object
+	if current, err := d.backend.routeLister.ByNamespace(d.namespace).Get(route.GetName()); err == nil {
+		old = current
+	}
+	d.backend.plan(outcomeUpdated, "HTTPRoute", d.namespace, route.GetName(), old, route)
+	return route, nil
+}
+
+func (d *dryRunRoutes) Delete(ctx context.Context, name string, opts metav1.DeleteOptions, subresources ...string) error {
+	var old runtime.Object
+	if current, err := d.backend.routeLister.ByNamespace(d.namespace).Get(name); err == nil {
+		old = current
+	}
+	d.backend.plan(outcomeDeleted, "HTTPRoute", d.namespace, name, old, nil)
+	return nil
+}
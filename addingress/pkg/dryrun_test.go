@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	listercorev1 "k8s.io/client-go/listers/core/v1"
+	listernetv1 "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+// newDryRunController 返回 dry-run 模式的控制器。dry-run 模式下不会发出写请求，客户端指向一个不存在的 apiserver
+func newDryRunController(t *testing.T, objs ...interface{}) *controller {
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating client: %v", err)
+	}
+	c := newQueueController()
+	c.client = client
+	c.recorder = record.NewFakeRecorder(10)
+	c.opts.DryRun = true
+	c.dryRun = &dryRunPlan{changes: map[string]plannedChange{}}
+	c.backends = map[string]routeBackend{backendIngress: &ingressBackend{controller: c}}
+
+	var services, ingresses []interface{}
+	for _, obj := range objs {
+		if _, ok := obj.(*corev1.Service); ok {
+			services = append(services, obj)
+		} else {
+			ingresses = append(ingresses, obj)
+		}
+	}
+	c.serviceLister = listercorev1.NewServiceLister(newIndexer(services...))
+	c.ingressLister = listernetv1.NewIngressLister(newIndexer(ingresses...))
+	return c
+}
+
+func TestDryRunReport(t *testing.T) {
+	created := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name: "created", Namespace: metav1.NamespaceDefault, UID: types.UID("created-uid"),
+		Annotations: map[string]string{annoKey: "true"},
+	}}
+	deleted := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: metav1.NamespaceDefault, UID: types.UID("deleted-uid")}}
+	c := newDryRunController(t, created, deleted, ownedIngress(deleted, "1"))
+
+	var out bytes.Buffer
+	if err := c.Report(&out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report := out.String()
+	for _, line := range []string{
+		"created Ingress default/created\n",
+		"deleted Ingress default/deleted\n",
+		"2 services, 1 to create, 0 to update, 1 to delete\n",
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("Expected report to contain %q, got:\n%s", line, report)
+		}
+	}
+	// 计划创建的ingress，diff 中包含期望的 spec
+	if !strings.Contains(report, `"ingressClassName": string("ingress")`) {
+		t.Errorf("Expected report to contain the diff of the created ingress, got:\n%s", report)
+	}
+}
+
+func TestReportRequiresDryRun(t *testing.T) {
+	c := newQueueController()
+	if err := c.Report(&bytes.Buffer{}); err == nil {
+		t.Errorf("Expected error calling Report outside dry-run mode")
+	}
+}
+
+func TestDryRunReportsSharedIngressOnce(t *testing.T) {
+	service := func(name string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Namespace: metav1.NamespaceDefault, UID: types.UID(name + "-uid"),
+			Annotations: map[string]string{annoKey: "true", annoPath: "/" + name},
+		}}
+	}
+	c := newDryRunController(t, service("api"), service("web"))
+	c.opts.AggregateByHost = true
+
+	var out bytes.Buffer
+	if err := c.Report(&out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// 共享ingress被每个成员service计划一次，只报告一次
+	report := out.String()
+	if count := strings.Count(report, "created Ingress default/"+defaultHost+"\n"); count != 1 {
+		t.Errorf("Expected the shared ingress to be reported once, got %d times:\n%s", count, report)
+	}
+	if !strings.Contains(report, "2 services, 1 to create, 0 to update, 0 to delete\n") {
+		t.Errorf("Expected a summary with 1 ingress to create, got:\n%s", report)
+	}
+}
@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"text/template"
+)
+
+// hostTemplateData --host-template 模板中可以使用的字段，比如 {{.Name}}.{{.Namespace}}.apps.corp.internal、{{required (index .Labels "team")}}.example.com
+type hostTemplateData struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// ParseHostTemplate 解析 --host-template 参数。
+// missingkey=error 只对 {{.Labels.team}} 这样的字段访问生效，{{index .Labels "team"}} 在 label 不存在时渲染为空字符串，
+// 需要用 required 包起来，label、annotation 不存在或为空时渲染失败
+func ParseHostTemplate(text string) (*template.Template, error) {
+	return template.New("host").Option("missingkey=error").Funcs(template.FuncMap{"required": required}).Parse(text)
+}
+
+// required 模板函数，值为空时返回错误
+func required(value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("required value is empty")
+	}
+	return value, nil
+}
+
+// renderHost 用service的名称、namespace、labels、annotations渲染 host 模板，并校验渲染出的 host 是合法的 DNS-1123 子域名
+func renderHost(tmpl *template.Template, service *corev1.Service) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, hostTemplateData{
+		Name:        service.Name,
+		Namespace:   service.Namespace,
+		Labels:      service.Labels,
+		Annotations: service.Annotations,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render host template: %v", err)
+	}
+	host := buf.String()
+	// 模板渲染出的 host 不允许使用通配符，通配符 host 需要通过 ingress/host 显式声明
+	if msgs := validation.IsDNS1123Subdomain(host); len(msgs) != 0 {
+		return "", fmt.Errorf("host template rendered invalid host %q: %v", host, messagesError(msgs))
+	}
+	return host, nil
+}
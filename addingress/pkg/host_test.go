@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderHost(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:      "web",
+		Namespace: "shop",
+		Labels:    map[string]string{"team": "payments"},
+	}}
+	tests := []struct {
+		name      string
+		template  string
+		expected  string
+		expectErr bool
+	}{
+		{name: "name and namespace", template: "{{.Name}}.{{.Namespace}}.apps.example.com", expected: "web.shop.apps.example.com"},
+		{name: "label", template: `{{index .Labels "team"}}.example.com`, expected: "payments.example.com"},
+		{name: "missing annotation", template: `{{.Annotations.owner}}.example.com`, expectErr: true},
+		{name: "required label", template: `{{required (index .Labels "team")}}.example.com`, expected: "payments.example.com"},
+		// missingkey=error 不检查 index，不存在的 label 需要用 required
+		{name: "missing required label", template: `{{required (index .Labels "owner")}}.example.com`, expectErr: true},
+		{name: "invalid host", template: "{{.Name}}_{{.Namespace}}.example.com", expectErr: true},
+		{name: "wildcard host", template: "*.{{.Namespace}}.example.com", expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := ParseHostTemplate(test.template)
+			if err != nil {
+				t.Fatalf("Unexpected error parsing template: %v", err)
+			}
+			host, err := renderHost(tmpl, service)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got host %q", host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if host != test.expected {
+				t.Errorf("Expected host %q, got %q", test.expected, host)
+			}
+		})
+	}
+}
+
+func TestParseIngressOptionsHostTemplate(t *testing.T) {
+	tmpl, err := ParseHostTemplate("{{.Name}}.{{.Namespace}}.apps.example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing template: %v", err)
+	}
+	c := newQueueController()
+	c.opts.HostTemplate = tmpl
+
+	opts, err := c.parseIngressOptions(annotatedService(map[string]string{annoKey: "true"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.host != "test.default.apps.example.com" {
+		t.Errorf("Expected host from the template, got %q", opts.host)
+	}
+	// ingress/host 优先于 --host-template
+	opts, err = c.parseIngressOptions(annotatedService(map[string]string{annoKey: "true", annoHost: "app.example.com"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.host != "app.example.com" {
+		t.Errorf("Expected host from the annotation, got %q", opts.host)
+	}
+}
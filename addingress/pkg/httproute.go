@@ -0,0 +1,295 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// HTTPRouteResource Gateway API 中 HTTPRoute 资源的 GVR。
+// 项目没有引入 Gateway API 的 Go 类型，HTTPRoute 通过 dynamic client 以 unstructured 的形式读写
+var HTTPRouteResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1",
+	Resource: "httproutes",
+}
+
+// httpRouteBackend 使用 Gateway API 的 HTTPRoute 暴露service，HTTPRoute 挂载到启动参数指定的 Gateway 上
+type httpRouteBackend struct {
+	*controller
+	dynamicClient dynamic.Interface
+	routeLister   cache.GenericLister
+	// HTTPRoute 的 parentRef 指向的 Gateway，namespace 为空时表示与 HTTPRoute 在同一个namespace
+	gatewayNamespace string
+	gatewayName      string
+}
+
+// EnableHTTPRoute 启用 httproute 后端，gateway 的格式为 namespace/name 或 name。
+// 与 NewController 一样，每个监听的namespace对应一个 routeInformer。
+// 需要在 Run 之前调用，并由调用方启动 routeInformers、等待其完成同步
+func (c *controller) EnableHTTPRoute(dynamicClient dynamic.Interface, routeInformers []informers.GenericInformer, gateway string) error {
+	gatewayNamespace, gatewayName, err := cache.SplitMetaNamespaceKey(gateway)
+	if err != nil {
+		return err
+	}
+	if gatewayName == "" {
+		return fmt.Errorf("gateway name must not be empty")
+	}
+
+	var routeLister multiGenericLister
+	for _, routeInformer := range routeInformers {
+		// 与 ingress 一样，HTTPRoute 被修改或删除时，将控制它的service加入workqueue
+		routeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: c.updateRoute,
+			DeleteFunc: c.deleteRoute,
+		})
+		routeLister = append(routeLister, routeInformer.Lister())
+		c.synced = append(c.synced, routeInformer.Informer().HasSynced)
+	}
+
+	c.backends[backendHTTPRoute] = &httpRouteBackend{
+		controller:       c,
+		dynamicClient:    dynamicClient,
+		routeLister:      routeLister,
+		gatewayNamespace: gatewayNamespace,
+		gatewayName:      gatewayName,
+	}
+	return nil
+}
+
+// 修改HTTPRoute时触发
+func (c *controller) updateRoute(oldObj interface{}, newObj interface{}) {
+	oldRoute := oldObj.(*unstructured.Unstructured)
+	newRoute := newObj.(*unstructured.Unstructured)
+	// resourceVersion 相同，说明是informer的定期resync，HTTPRoute并没有变化
+	if oldRoute.GetResourceVersion() == newRoute.GetResourceVersion() {
+		return
+	}
+	c.enqueueController(newRoute)
+}
+
+// 删除HTTPRoute时触发
+func (c *controller) deleteRoute(obj interface{}) {
+	route, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("couldn't get object from tombstone %#v", obj))
+			return
+		}
+		route, ok = tombstone.Obj.(*unstructured.Unstructured)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("tombstone contained object that is not an HTTPRoute %#v", obj))
+			return
+		}
+	}
+	c.enqueueController(route)
+}
+
+// sync 为service创建或更新HTTPRoute
+func (b *httpRouteBackend) sync(service *corev1.Service, opts *ingressOptions) (syncOutcome, error) {
+	desired, err := b.createHTTPRoute(service, opts)
+	if err != nil {
+		// annotation 与 HTTPRoute 不兼容，重试无法修复
+		b.recorder.Event(service, corev1.EventTypeWarning, reasonInvalidAnnotation, err.Error())
+		return outcomeSkipped, nil
+	}
+
+	namespace := service.Namespace
+	route, err := b.ownedRoute(service)
+	if err != nil {
+		return outcomeSkipped, err
+	}
+	if route == nil {
+		// 从indexer缓存中，获取与service同名的HTTPRoute
+		obj, err := b.routeLister.ByNamespace(namespace).Get(service.Name)
+		if errors.IsNotFound(err) {
+			_, err = b.routes(namespace).Create(context.TODO(), desired, metav1.CreateOptions{})
+			return b.recordOutcome(service, outcomeCreated, "HTTPRoute", namespace, desired.GetName(), err)
+		}
+		if err != nil {
+			return outcomeSkipped, err
+		}
+		// HTTPRoute已存在，但不是由这个service控制的，按 --adopt-policy 处理
+		return b.resolveRouteConflict(service, obj.(*unstructured.Unstructured), desired)
+	}
+	return b.updateRoute(service, route, desired, false)
+}
+
+// ownedRoute 从缓存中找出由service控制的HTTPRoute，依次查找与service同名、以及 rename 模式下生成的名称。
+// 没有找到时返回 nil
+func (b *httpRouteBackend) ownedRoute(service *corev1.Service) (*unstructured.Unstructured, error) {
+	for _, name := range []string{service.Name, renamedName(service)} {
+		obj, err := b.routeLister.ByNamespace(service.Namespace).Get(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		route := obj.(*unstructured.Unstructured)
+		if metav1.IsControlledBy(route, service) {
+			return route, nil
+		}
+	}
+	return nil, nil
+}
+
+// resolveRouteConflict 与service同名的HTTPRoute已存在、但不是由service控制时，按 --adopt-policy 处理，与ingress的处理方式相同
+func (b *httpRouteBackend) resolveRouteConflict(service *corev1.Service, existing, desired *unstructured.Unstructured) (syncOutcome, error) {
+	namespace := service.Namespace
+	switch b.opts.AdoptPolicy {
+	case adoptPolicyAdopt:
+		// HTTPRoute已经有其它的 controller，不能再接管
+		if owner := metav1.GetControllerOf(existing); owner != nil {
+			b.recorder.Eventf(service, corev1.EventTypeWarning, reasonHTTPRouteExists,
+				"HTTPRoute %s/%s is controlled by %s %s, not adopting it", namespace, existing.GetName(), owner.Kind, owner.Name)
+			return outcomeSkipped, nil
+		}
+		// 保留HTTPRoute上原有的 OwnerReference，加上指向service的 controller OwnerReference
+		adopted := existing.DeepCopy()
+		adopted.SetOwnerReferences(append(adopted.GetOwnerReferences(), desired.GetOwnerReferences()...))
+		outcome, err := b.updateRoute(service, adopted, desired, true)
+		if err == nil {
+			b.recorder.Eventf(service, corev1.EventTypeNormal, reasonAdopted, "Adopted HTTPRoute %s/%s", namespace, existing.GetName())
+		}
+		return outcome, err
+	case adoptPolicyRename:
+		desired.SetName(renamedName(service))
+		_, err := b.routes(namespace).Create(context.TODO(), desired, metav1.CreateOptions{})
+		return b.recordOutcome(service, outcomeCreated, "HTTPRoute", namespace, desired.GetName(), err)
+	default:
+		b.recorder.Eventf(service, corev1.EventTypeWarning, reasonHTTPRouteExists,
+			"HTTPRoute %s/%s already exists and is not controlled by this Service", namespace, existing.GetName())
+		return outcomeSkipped, nil
+	}
+}
+
+// updateRoute 将 route 的 spec 更新为期望的 spec。只比较控制器设置的字段，apiserver 设置的默认值不参与比较，
+// 不同版本的 Gateway API CRD 默认值不同时，也不会每次调谐都更新。force 为 true 时总是更新，比如接管时需要写入 OwnerReference
+func (b *httpRouteBackend) updateRoute(service *corev1.Service, route, desired *unstructured.Unstructured, force bool) (syncOutcome, error) {
+	if !force && containsFields(route.Object["spec"], desired.Object["spec"]) {
+		return outcomeSkipped, nil
+	}
+	update := route.DeepCopy()
+	update.Object["spec"] = desired.Object["spec"]
+	_, err := b.routes(route.GetNamespace()).Update(context.TODO(), update, metav1.UpdateOptions{})
+	return b.recordOutcome(service, outcomeUpdated, "HTTPRoute", route.GetNamespace(), route.GetName(), err)
+}
+
+// containsFields 判断 actual 是否包含 desired 中设置的所有字段。
+// map 只比较 desired 中的 key；list 的长度必须相同，并逐个元素比较
+func containsFields(actual, desired interface{}) bool {
+	switch desired := desired.(type) {
+	case map[string]interface{}:
+		actual, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range desired {
+			if !containsFields(actual[key], value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok || len(actual) != len(desired) {
+			return false
+		}
+		for i := range desired {
+			if !containsFields(actual[i], desired[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return equality.Semantic.DeepEqual(actual, desired)
+	}
+}
+
+// cleanup 删除由service控制的HTTPRoute
+func (b *httpRouteBackend) cleanup(service *corev1.Service) (syncOutcome, error) {
+	route, err := b.ownedRoute(service)
+	if err != nil || route == nil {
+		return outcomeSkipped, err
+	}
+	err = b.routes(route.GetNamespace()).Delete(context.TODO(), route.GetName(), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return outcomeSkipped, nil
+	}
+	return b.recordOutcome(service, outcomeDeleted, "HTTPRoute", route.GetNamespace(), route.GetName(), err)
+}
+
+// createHTTPRoute 根据service和解析出的annotation参数，创建HTTPRoute。
+// group、kind、weight 等字段由 apiserver 按 CRD 设置默认值，这里不设置，比较时只比较这里设置的字段
+func (b *httpRouteBackend) createHTTPRoute(service *corev1.Service, opts *ingressOptions) (*unstructured.Unstructured, error) {
+	var matchType string
+	switch opts.pathType {
+	case netv1.PathTypeExact:
+		matchType = "Exact"
+	case netv1.PathTypePrefix:
+		matchType = "PathPrefix"
+	default:
+		return nil, fmt.Errorf("path type %s is not supported by HTTPRoute", opts.pathType)
+	}
+
+	// 每条 path 对应一条规则。HTTPRoute 的 backendRef 只支持端口号，使用从service的端口中查到的端口号
+	var rules []interface{}
+	for _, path := range opts.paths {
+		if path.number == 0 {
+			return nil, fmt.Errorf("port %q of path %s has no port number on the service", path.port.Name, path.path)
+		}
+		rules = append(rules, map[string]interface{}{
+			"matches": []interface{}{
+				map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":  matchType,
+						"value": path.path,
+					},
+				},
+			},
+			"backendRefs": []interface{}{
+				map[string]interface{}{
+					"name": service.Name,
+					"port": int64(path.number),
+				},
+			},
+		})
+	}
+
+	parentRef := map[string]interface{}{
+		"name": b.gatewayName,
+	}
+	if b.gatewayNamespace != "" {
+		parentRef["namespace"] = b.gatewayNamespace
+	}
+
+	route := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"parentRefs": []interface{}{parentRef},
+				"hostnames":  []interface{}{opts.host},
+				"rules":      rules,
+			},
+		},
+	}
+	route.SetAPIVersion(HTTPRouteResource.GroupVersion().String())
+	route.SetKind("HTTPRoute")
+	route.SetName(service.Name)
+	route.SetNamespace(service.Namespace)
+	route.SetOwnerReferences([]metav1.OwnerReference{
+		*metav1.NewControllerRef(service, corev1.SchemeGroupVersion.WithKind("Service")),
+	})
+	return route, nil
+}
@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCreateHTTPRoute(t *testing.T) {
+	b := &httpRouteBackend{gatewayNamespace: "gateways", gatewayName: "public"}
+	service := ownerService()
+	service.Annotations = map[string]string{annoKey: "true", annoPath: "/api", annoPort: "http"}
+	service.Spec.Ports = []corev1.ServicePort{{Name: "grpc", Port: 9090}, {Name: "http", Port: 8080}}
+	opts, err := parseOptions(service)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	route, err := b.createHTTPRoute(service, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	parentRefs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	expectedParent := map[string]interface{}{"name": "public", "namespace": "gateways"}
+	if len(parentRefs) != 1 || !reflect.DeepEqual(parentRefs[0], expectedParent) {
+		t.Errorf("Expected parentRefs [%v], got %v", expectedParent, parentRefs)
+	}
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	rule := rules[0].(map[string]interface{})
+	path := rule["matches"].([]interface{})[0].(map[string]interface{})["path"]
+	if expected := map[string]interface{}{"type": "PathPrefix", "value": "/api"}; !reflect.DeepEqual(path, expected) {
+		t.Errorf("Expected path match %v, got %v", expected, path)
+	}
+	// 端口名按service的端口解析成端口号
+	if port := rule["backendRefs"].([]interface{})[0].(map[string]interface{})["port"]; port != int64(8080) {
+		t.Errorf("Expected backend port 8080, got %v", port)
+	}
+	if owner := route.GetOwnerReferences(); len(owner) != 1 || owner[0].UID != service.UID {
+		t.Errorf("Expected the service to control the HTTPRoute, got %+v", owner)
+	}
+}
+
+func TestCreateHTTPRouteUnsupported(t *testing.T) {
+	b := &httpRouteBackend{gatewayName: "public"}
+	service := ownerService()
+
+	opts, _ := parseOptions(annotatedService(map[string]string{annoKey: "true", annoPathType: "ImplementationSpecific"}))
+	if _, err := b.createHTTPRoute(service, opts); err == nil {
+		t.Errorf("Expected error for path type ImplementationSpecific")
+	}
+	opts, _ = parseOptions(annotatedService(map[string]string{annoKey: "true", annoPort: "grpc"}))
+	if _, err := b.createHTTPRoute(service, opts); err == nil {
+		t.Errorf("Expected error for a port name without a port number")
+	}
+}
+
+func TestContainsFields(t *testing.T) {
+	desired := map[string]interface{}{
+		"parentRefs": []interface{}{map[string]interface{}{"name": "gateway"}},
+		"rules": []interface{}{map[string]interface{}{
+			"backendRefs": []interface{}{map[string]interface{}{"name": "test", "port": int64(8080)}},
+		}},
+	}
+	// apiserver 按 CRD 设置了默认值的 HTTPRoute
+	defaulted := map[string]interface{}{
+		"parentRefs": []interface{}{map[string]interface{}{"group": "gateway.networking.k8s.io", "kind": "Gateway", "name": "gateway"}},
+		"rules": []interface{}{map[string]interface{}{
+			"backendRefs": []interface{}{map[string]interface{}{"group": "", "kind": "Service", "name": "test", "port": int64(8080), "weight": int64(1)}},
+			"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/"}}},
+		}},
+	}
+	if !containsFields(defaulted, desired) {
+		t.Errorf("Expected defaulted HTTPRoute spec to contain the desired fields")
+	}
+
+	changed := map[string]interface{}{
+		"parentRefs": []interface{}{map[string]interface{}{"name": "gateway"}},
+		"rules": []interface{}{map[string]interface{}{
+			"backendRefs": []interface{}{map[string]interface{}{"name": "test", "port": int64(9090)}},
+		}},
+	}
+	if containsFields(changed, desired) {
+		t.Errorf("Expected HTTPRoute spec with a different port not to contain the desired fields")
+	}
+	extraRule := map[string]interface{}{
+		"parentRefs": desired["parentRefs"],
+		"rules":      append([]interface{}{}, desired["rules"].([]interface{})[0], desired["rules"].([]interface{})[0]),
+	}
+	if containsFields(extraRule, desired) {
+		t.Errorf("Expected HTTPRoute spec with an extra rule not to contain the desired fields")
+	}
+}
+
+func TestResolveRouteConflictWithoutWrites(t *testing.T) {
+	service := ownerService()
+	existing := &unstructured.Unstructured{}
+	existing.SetName(service.Name)
+	existing.SetNamespace(service.Namespace)
+	other := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: service.Namespace, UID: types.UID("other-uid")}}
+	controlled := existing.DeepCopy()
+	controlled.SetOwnerReferences([]metav1.OwnerReference{*metav1.NewControllerRef(other, corev1.SchemeGroupVersion.WithKind("Service"))})
+
+	tests := []struct {
+		name     string
+		policy   string
+		existing *unstructured.Unstructured
+		event    string
+	}{
+		{name: "ignore", policy: adoptPolicyIgnore, existing: existing, event: "Warning " + reasonHTTPRouteExists + " HTTPRoute default/test already exists"},
+		{name: "adopt controlled route", policy: adoptPolicyAdopt, existing: controlled, event: "Warning " + reasonHTTPRouteExists + " HTTPRoute default/test is controlled by Service other"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newQueueController()
+			recorder := record.NewFakeRecorder(10)
+			c.recorder = recorder
+			c.opts.AdoptPolicy = test.policy
+			b := &httpRouteBackend{controller: c}
+
+			outcome, err := b.resolveRouteConflict(service, test.existing, &unstructured.Unstructured{})
+			if outcome != outcomeSkipped || err != nil {
+				t.Errorf("Expected the HTTPRoute to be skipped, got %s, %v", outcome, err)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, test.event) {
+					t.Errorf("Expected event %q, got %q", test.event, event)
+				}
+			default:
+				t.Errorf("Expected event %q, got none", test.event)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ingressBackend 使用 networking/v1 的 Ingress 暴露service
+type ingressBackend struct {
+	*controller
+}
+
+// sync 为service创建或更新ingress
+func (b *ingressBackend) sync(service *corev1.Service, opts *ingressOptions) (syncOutcome, error) {
+	// service声明的路由已经被更早的ingress占用，不生成重复的ingress
+	conflict, route, err := b.routeConflict(service, opts)
+	if err != nil {
+		return outcomeSkipped, err
+	}
+	if err := b.updateServiceConflict(service, conflict, route); err != nil {
+		return outcomeSkipped, err
+	}
+	if conflict != nil {
+		b.recorder.Eventf(service, corev1.EventTypeWarning, reasonRouteConflict,
+			"Route %s is already claimed by Ingress %s/%s", route, conflict.Namespace, conflict.Name)
+		// 删除service之前生成的ingress，共享ingress模式下从共享ingress中移除service
+		outcome, err := b.cleanup(service)
+		if err != nil {
+			return outcome, err
+		}
+		return outcome, b.updateServiceAddress(service, nil, nil)
+	}
+
+	// 共享ingress的模式，由service所在的共享ingress统一处理
+	if b.opts.AggregateByHost {
+		outcome, err := b.syncSharedIngresses(service.Namespace, service.Name, service)
+		if err != nil {
+			return outcome, err
+		}
+		// 将共享ingress的负载均衡地址写回service
+		ingress, err := b.ingressLister.Ingresses(service.Namespace).Get(sharedIngressName(opts.host))
+		if err != nil && !errors.IsNotFound(err) {
+			return outcome, err
+		}
+		if ingress != nil && !isSharedIngress(ingress) {
+			ingress = nil
+		}
+		return outcome, b.updateServiceAddress(service, ingress, opts)
+	}
+
+	namespace := service.Namespace
+	// 根据service计算出期望的ingress
+	desired := b.createIngress(service, opts)
+
+	// 从indexer缓存中，获取由service控制的ingress
+	ingress, err := b.ownedIngress(service)
+	if err != nil {
+		return outcomeSkipped, err
+	}
+
+	if ingress == nil {
+		existing, err := b.ingressLister.Ingresses(namespace).Get(desired.Name)
+		if err != nil && !errors.IsNotFound(err) {
+			return outcomeSkipped, err
+		}
+		// 同名的ingress已存在，但不是由这个service控制的
+		if existing != nil {
+			return b.resolveConflict(service, existing, desired)
+		}
+		// ingress不存在，但是service有"ingress/http"，需要创建ingress
+		outcome, err := b.applyIngress(service, nil, desired, false)
+		return b.recordOutcome(service, outcome, "Ingress", namespace, desired.Name, err)
+	}
+
+	// ingress已存在，与期望不一致时更新。名称以已存在的ingress为准，rename 模式下两者不同
+	desired.Name = ingress.Name
+	outcome, err := b.applyIngress(service, ingress, desired, false)
+	if outcome, err = b.recordOutcome(service, outcome, "Ingress", namespace, ingress.Name, err); err != nil {
+		return outcome, err
+	}
+	// 将ingress的负载均衡地址写回service
+	return outcome, b.updateServiceAddress(service, ingress, opts)
+}
+
+// cleanup 删除由service控制的ingress，不是由service控制的ingress不会被删除
+func (b *ingressBackend) cleanup(service *corev1.Service) (syncOutcome, error) {
+	// 共享ingress的模式，由service所在的共享ingress统一处理
+	if b.opts.AggregateByHost {
+		return b.syncSharedIngresses(service.Namespace, service.Name, service)
+	}
+
+	// 从indexer缓存中，获取由service控制的ingress
+	ingress, err := b.ownedIngress(service)
+	if err != nil || ingress == nil {
+		return outcomeSkipped, err
+	}
+	// ingress存在，但是service不再使用ingress，需要删除ingress
+	// 调用controller中的client，完成ingress的删除
+	err = b.ingresses(ingress.Namespace).Delete(context.TODO(), ingress.Name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return outcomeSkipped, nil
+	}
+	return b.recordOutcome(service, outcomeDeleted, "Ingress", ingress.Namespace, ingress.Name, err)
+}
+
+// createIngress 根据service和解析出的annotation参数，创建ingress
+func (c *controller) createIngress(service *corev1.Service, opts *ingressOptions) *netv1.Ingress {
+	icn := opts.ingressClassName
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service.Name,
+			Namespace: service.Namespace,
+			Labels: map[string]string{
+				labelManagedBy: managedByValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(service, corev1.SchemeGroupVersion.WithKind("Service")),
+			},
+		},
+		Spec: netv1.IngressSpec{
+			IngressClassName: &icn,
+			Rules: []netv1.IngressRule{
+				{
+					Host: opts.host,
+					IngressRuleValue: netv1.IngressRuleValue{
+						HTTP: &netv1.HTTPIngressRuleValue{
+							Paths: ingressPaths(service, opts),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	setIngressTLS(ingress, opts)
+	copyIngressAnnotations(ingress, opts)
+	return ingress
+}
+
+// ingressPaths 生成将每条 path 转发到 service 端口的规则
+func ingressPaths(service *corev1.Service, opts *ingressOptions) []netv1.HTTPIngressPath {
+	var paths []netv1.HTTPIngressPath
+	for _, path := range opts.paths {
+		pathType := opts.pathType
+		paths = append(paths, netv1.HTTPIngressPath{
+			Path:     path.path,
+			PathType: &pathType,
+			Backend: netv1.IngressBackend{
+				Service: &netv1.IngressServiceBackend{
+					Name: service.Name,
+					Port: path.port,
+				},
+			},
+		})
+	}
+	return paths
+}
+
+// copyIngressAnnotations 将service上带前缀的annotation复制到ingress上。
+// ingress上已有的annotation由控制器设置（比如 cert-manager 的 issuer），不会被覆盖
+func copyIngressAnnotations(ingress *netv1.Ingress, opts *ingressOptions) {
+	for key, value := range opts.ingressAnnotations {
+		if _, ok := ingress.Annotations[key]; ok {
+			continue
+		}
+		metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, key, value)
+	}
+}
+
+// setIngressTLS 开启TLS时，为host配置证书secret；指定了issuer时，由cert-manager自动签发证书到这个secret中
+func setIngressTLS(ingress *netv1.Ingress, opts *ingressOptions) {
+	if !opts.tls {
+		return
+	}
+	ingress.Spec.TLS = []netv1.IngressTLS{
+		{
+			Hosts:      []string{opts.host},
+			SecretName: opts.tlsSecret,
+		},
+	}
+	if opts.clusterIssuer != "" {
+		metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, certManagerClusterIssuer, opts.clusterIssuer)
+	}
+	if opts.issuer != "" {
+		metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, certManagerIssuer, opts.issuer)
+	}
+}
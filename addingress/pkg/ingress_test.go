@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	netv1 "k8s.io/api/networking/v1"
+)
+
+func TestCreateIngressTLS(t *testing.T) {
+	c := newQueueController()
+	opts, err := parseOptions(annotatedService(map[string]string{annoKey: "true", annoHost: "app.example.com", annoIssuer: "local"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ingress := c.createIngress(ownerService(), opts)
+
+	expected := []netv1.IngressTLS{{Hosts: []string{"app.example.com"}, SecretName: "test-tls"}}
+	if !reflect.DeepEqual(ingress.Spec.TLS, expected) {
+		t.Errorf("Expected tls %+v, got %+v", expected, ingress.Spec.TLS)
+	}
+	if ingress.Annotations[certManagerIssuer] != "local" {
+		t.Errorf("Expected annotation %s=local, got %v", certManagerIssuer, ingress.Annotations)
+	}
+}
+
+func TestCreateIngressCopiesAnnotations(t *testing.T) {
+	c := newQueueController()
+	c.opts.AnnotationPrefix = "ingress.addingress.io/"
+	opts, err := c.parseIngressOptions(annotatedService(map[string]string{
+		annoKey:    "true",
+		annoIssuer: "local",
+		"ingress.addingress.io/nginx.ingress.kubernetes.io/proxy-body-size": "8m",
+		"ingress.addingress.io/" + certManagerIssuer:                        "other",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ingress := c.createIngress(ownerService(), opts)
+
+	expected := map[string]string{
+		"nginx.ingress.kubernetes.io/proxy-body-size": "8m",
+		// 控制器设置的annotation不会被覆盖
+		certManagerIssuer: "local",
+	}
+	if !reflect.DeepEqual(ingress.Annotations, expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, ingress.Annotations)
+	}
+}
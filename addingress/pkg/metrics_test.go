@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSyncOutcomeMerge(t *testing.T) {
+	tests := []struct {
+		outcomes []syncOutcome
+		expected syncOutcome
+	}{
+		{outcomes: nil, expected: outcomeSkipped},
+		{outcomes: []syncOutcome{outcomeSkipped, outcomeSkipped}, expected: outcomeSkipped},
+		{outcomes: []syncOutcome{outcomeCreated, outcomeSkipped}, expected: outcomeCreated},
+		// 切换后端时先删除旧的路由对象，再创建新的，以最后的操作为准
+		{outcomes: []syncOutcome{outcomeDeleted, outcomeCreated}, expected: outcomeCreated},
+	}
+	for _, test := range tests {
+		outcome := outcomeSkipped
+		for _, o := range test.outcomes {
+			outcome = outcome.merge(o)
+		}
+		if outcome != test.expected {
+			t.Errorf("Expected %v to merge into %s, got %s", test.outcomes, test.expected, outcome)
+		}
+	}
+}
+
+func TestObserveSync(t *testing.T) {
+	// 从注册的指标中读取 outcome="updated" 的失败次数
+	errorCount := func() float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatalf("Unexpected error gathering metrics: %v", err)
+		}
+		for _, family := range families {
+			if family.GetName() != metricsNamespace+"_sync_errors_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "outcome" && label.GetValue() == string(outcomeUpdated) {
+						return metric.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+	before := errorCount()
+
+	observeSync(outcomeUpdated, time.Millisecond, nil)
+	if got := errorCount(); got != before {
+		t.Errorf("Expected successful sync not to count as an error, got %v errors", got-before)
+	}
+	observeSync(outcomeUpdated, time.Millisecond, errors.New("conflict"))
+	if got := errorCount(); got != before+1 {
+		t.Errorf("Expected 1 more error, got %v", got-before)
+	}
+}
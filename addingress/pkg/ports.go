@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"strings"
+)
+
+// 没有设置 ingress/port 时，service 有多个端口的情况下优先使用这个名称的端口
+const defaultPortName = "http"
+
+// backendPath 一条转发到service端口的path
+type backendPath struct {
+	path string
+	// port ingress 中引用的端口，设置了 annotation 时与 annotation 一致，是端口名或端口号
+	port netv1.ServiceBackendPort
+	// number 端口号，按端口名引用时从 service.Spec.Ports 中查到。HTTPRoute 只支持端口号
+	number int32
+}
+
+// pathPort 从 annotation 中解析出的一条path及其端口，port 为 nil 表示没有指定端口
+type pathPort struct {
+	path string
+	port *netv1.ServiceBackendPort
+}
+
+// parsePathPorts 解析 ingress/paths 的值，格式为逗号分隔的 path=port，比如 /api=grpc,/=http
+func parsePathPorts(value string) ([]pathPort, error) {
+	var result []pathPort
+	paths := sets.NewString()
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		path, port, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q must be in the form path=port", item)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q must be an absolute path", path)
+		}
+		if paths.Has(path) {
+			return nil, fmt.Errorf("path %q is listed more than once", path)
+		}
+		paths.Insert(path)
+		backendPort, err := parsePort(port)
+		if err != nil {
+			return nil, fmt.Errorf("port %q: %v", port, err)
+		}
+		result = append(result, pathPort{path: path, port: &backendPort})
+	}
+	return result, nil
+}
+
+// selectServicePort 从 service.Spec.Ports 中选择端口。
+// requested 为 nil 时：service只有一个端口就使用它；有多个端口时优先使用名为 http 的端口，否则使用第一个端口；
+// service 没有端口（比如 ExternalName 类型）时使用默认的 80 端口。
+// requested 不为 nil 时，service 上必须有这个端口名或端口号的端口
+func selectServicePort(service *corev1.Service, requested *netv1.ServiceBackendPort) (netv1.ServiceBackendPort, int32, error) {
+	ports := service.Spec.Ports
+	if requested == nil {
+		if len(ports) == 0 {
+			return netv1.ServiceBackendPort{Number: defaultPort}, defaultPort, nil
+		}
+		selected := ports[0]
+		for _, port := range ports {
+			if port.Name == defaultPortName {
+				selected = port
+				break
+			}
+		}
+		return netv1.ServiceBackendPort{Number: selected.Port}, selected.Port, nil
+	}
+
+	// service 没有声明端口时无法校验，按 annotation 原样使用
+	if len(ports) == 0 {
+		return *requested, requested.Number, nil
+	}
+	for _, port := range ports {
+		if requested.Name != "" && port.Name == requested.Name || requested.Name == "" && port.Port == requested.Number {
+			return *requested, port.Port, nil
+		}
+	}
+	if requested.Name != "" {
+		return netv1.ServiceBackendPort{}, 0, fmt.Errorf("service has no port named %q", requested.Name)
+	}
+	return netv1.ServiceBackendPort{}, 0, fmt.Errorf("service has no port %d", requested.Number)
+}
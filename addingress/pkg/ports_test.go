@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+)
+
+func TestParsePathPorts(t *testing.T) {
+	parsed, err := parsePathPorts("/api=grpc, /=8080")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []pathPort{
+		{path: "/api", port: &netv1.ServiceBackendPort{Name: "grpc"}},
+		{path: "/", port: &netv1.ServiceBackendPort{Number: 8080}},
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, parsed)
+	}
+
+	for _, value := range []string{"/api", "api=http", "/=http,/=grpc", "/=70000"} {
+		if _, err := parsePathPorts(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestSelectServicePort(t *testing.T) {
+	service := func(ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{Spec: corev1.ServiceSpec{Ports: ports}}
+	}
+	tests := []struct {
+		name      string
+		service   *corev1.Service
+		requested *netv1.ServiceBackendPort
+		expected  netv1.ServiceBackendPort
+		number    int32
+		expectErr bool
+	}{
+		{
+			name:     "no ports",
+			service:  service(),
+			expected: netv1.ServiceBackendPort{Number: defaultPort},
+			number:   defaultPort,
+		},
+		{
+			name:     "single port",
+			service:  service(corev1.ServicePort{Name: "web", Port: 8080}),
+			expected: netv1.ServiceBackendPort{Number: 8080},
+			number:   8080,
+		},
+		{
+			name:     "prefers http",
+			service:  service(corev1.ServicePort{Name: "grpc", Port: 9090}, corev1.ServicePort{Name: "http", Port: 8080}),
+			expected: netv1.ServiceBackendPort{Number: 8080},
+			number:   8080,
+		},
+		{
+			name:     "first port",
+			service:  service(corev1.ServicePort{Name: "grpc", Port: 9090}, corev1.ServicePort{Name: "metrics", Port: 8080}),
+			expected: netv1.ServiceBackendPort{Number: 9090},
+			number:   9090,
+		},
+		{
+			name:      "requested name",
+			service:   service(corev1.ServicePort{Name: "grpc", Port: 9090}, corev1.ServicePort{Name: "http", Port: 8080}),
+			requested: &netv1.ServiceBackendPort{Name: "grpc"},
+			expected:  netv1.ServiceBackendPort{Name: "grpc"},
+			number:    9090,
+		},
+		{
+			name:      "requested number",
+			service:   service(corev1.ServicePort{Name: "grpc", Port: 9090}),
+			requested: &netv1.ServiceBackendPort{Number: 9090},
+			expected:  netv1.ServiceBackendPort{Number: 9090},
+			number:    9090,
+		},
+		{
+			name:      "unknown name",
+			service:   service(corev1.ServicePort{Name: "http", Port: 8080}),
+			requested: &netv1.ServiceBackendPort{Name: "grpc"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown number",
+			service:   service(corev1.ServicePort{Name: "http", Port: 8080}),
+			requested: &netv1.ServiceBackendPort{Number: 9090},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port, number, err := selectServicePort(test.service, test.requested)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got port %+v", port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if port != test.expected || number != test.number {
+				t.Errorf("Expected port %+v (%d), got %+v (%d)", test.expected, test.number, port, number)
+			}
+		})
+	}
+}
+
+func TestParseIngressOptionsPaths(t *testing.T) {
+	service := annotatedService(map[string]string{annoKey: "true", annoPaths: "/api=grpc,/=http"})
+	service.Spec.Ports = []corev1.ServicePort{{Name: "grpc", Port: 9090}, {Name: "http", Port: 8080}}
+	opts, err := parseOptions(service)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []backendPath{
+		{path: "/api", port: netv1.ServiceBackendPort{Name: "grpc"}, number: 9090},
+		{path: "/", port: netv1.ServiceBackendPort{Name: "http"}, number: 8080},
+	}
+	if !reflect.DeepEqual(opts.paths, expected) {
+		t.Errorf("Expected paths %+v, got %+v", expected, opts.paths)
+	}
+
+	// ingress/paths 与 ingress/path、ingress/port 不能同时设置
+	service.Annotations[annoPort] = "http"
+	if _, err := parseOptions(service); err == nil {
+		t.Errorf("Expected error when both %s and %s are set", annoPaths, annoPort)
+	}
+}
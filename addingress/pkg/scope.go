@@ -0,0 +1,210 @@
+package pkg
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	listercorev1 "k8s.io/client-go/listers/core/v1"
+	listernetv1 "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 控制器只监听部分namespace时，每个namespace都有各自的informer。
+// 下面的lister把多个informer的lister合并成一个，查询时依次查找每个lister，
+// 控制器中的其它代码不需要关心监听了哪些namespace。不在监听范围内的对象，总是返回 NotFound
+
+// multiServiceLister 合并多个 ServiceLister
+type multiServiceLister []listercorev1.ServiceLister
+
+func (l multiServiceLister) List(selector labels.Selector) ([]*corev1.Service, error) {
+	var ret []*corev1.Service
+	for _, lister := range l {
+		services, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, services...)
+	}
+	return ret, nil
+}
+
+func (l multiServiceLister) Services(namespace string) listercorev1.ServiceNamespaceLister {
+	return multiServiceNamespaceLister{listers: l, namespace: namespace}
+}
+
+type multiServiceNamespaceLister struct {
+	listers   multiServiceLister
+	namespace string
+}
+
+func (l multiServiceNamespaceLister) List(selector labels.Selector) ([]*corev1.Service, error) {
+	var ret []*corev1.Service
+	for _, lister := range l.listers {
+		services, err := lister.Services(l.namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, services...)
+	}
+	return ret, nil
+}
+
+func (l multiServiceNamespaceLister) Get(name string) (*corev1.Service, error) {
+	for _, lister := range l.listers {
+		service, err := lister.Services(l.namespace).Get(name)
+		if err == nil || !errors.IsNotFound(err) {
+			return service, err
+		}
+	}
+	return nil, errors.NewNotFound(corev1.Resource("service"), name)
+}
+
+// multiIngressLister 合并多个 IngressLister
+type multiIngressLister []listernetv1.IngressLister
+
+func (l multiIngressLister) List(selector labels.Selector) ([]*netv1.Ingress, error) {
+	var ret []*netv1.Ingress
+	for _, lister := range l {
+		ingresses, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ingresses...)
+	}
+	return ret, nil
+}
+
+func (l multiIngressLister) Ingresses(namespace string) listernetv1.IngressNamespaceLister {
+	return multiIngressNamespaceLister{listers: l, namespace: namespace}
+}
+
+type multiIngressNamespaceLister struct {
+	listers   multiIngressLister
+	namespace string
+}
+
+func (l multiIngressNamespaceLister) List(selector labels.Selector) ([]*netv1.Ingress, error) {
+	var ret []*netv1.Ingress
+	for _, lister := range l.listers {
+		ingresses, err := lister.Ingresses(l.namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ingresses...)
+	}
+	return ret, nil
+}
+
+func (l multiIngressNamespaceLister) Get(name string) (*netv1.Ingress, error) {
+	for _, lister := range l.listers {
+		ingress, err := lister.Ingresses(l.namespace).Get(name)
+		if err == nil || !errors.IsNotFound(err) {
+			return ingress, err
+		}
+	}
+	return nil, errors.NewNotFound(netv1.Resource("ingress"), name)
+}
+
+// multiConfigMapLister 合并多个 ConfigMapLister，用于默认值 ConfigMap
+type multiConfigMapLister []listercorev1.ConfigMapLister
+
+func (l multiConfigMapLister) List(selector labels.Selector) ([]*corev1.ConfigMap, error) {
+	var ret []*corev1.ConfigMap
+	for _, lister := range l {
+		configMaps, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, configMaps...)
+	}
+	return ret, nil
+}
+
+func (l multiConfigMapLister) ConfigMaps(namespace string) listercorev1.ConfigMapNamespaceLister {
+	return multiConfigMapNamespaceLister{listers: l, namespace: namespace}
+}
+
+type multiConfigMapNamespaceLister struct {
+	listers   multiConfigMapLister
+	namespace string
+}
+
+func (l multiConfigMapNamespaceLister) List(selector labels.Selector) ([]*corev1.ConfigMap, error) {
+	var ret []*corev1.ConfigMap
+	for _, lister := range l.listers {
+		configMaps, err := lister.ConfigMaps(l.namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, configMaps...)
+	}
+	return ret, nil
+}
+
+func (l multiConfigMapNamespaceLister) Get(name string) (*corev1.ConfigMap, error) {
+	for _, lister := range l.listers {
+		configMap, err := lister.ConfigMaps(l.namespace).Get(name)
+		if err == nil || !errors.IsNotFound(err) {
+			return configMap, err
+		}
+	}
+	return nil, errors.NewNotFound(corev1.Resource("configmap"), name)
+}
+
+// multiGenericLister 合并多个 GenericLister，用于 dynamic informer 监听的 HTTPRoute
+type multiGenericLister []cache.GenericLister
+
+func (l multiGenericLister) List(selector labels.Selector) ([]runtime.Object, error) {
+	var ret []runtime.Object
+	for _, lister := range l {
+		objs, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, objs...)
+	}
+	return ret, nil
+}
+
+func (l multiGenericLister) Get(name string) (runtime.Object, error) {
+	for _, lister := range l {
+		obj, err := lister.Get(name)
+		if err == nil || !errors.IsNotFound(err) {
+			return obj, err
+		}
+	}
+	return nil, errors.NewNotFound(HTTPRouteResource.GroupResource(), name)
+}
+
+func (l multiGenericLister) ByNamespace(namespace string) cache.GenericNamespaceLister {
+	return multiGenericNamespaceLister{listers: l, namespace: namespace}
+}
+
+type multiGenericNamespaceLister struct {
+	listers   multiGenericLister
+	namespace string
+}
+
+func (l multiGenericNamespaceLister) List(selector labels.Selector) ([]runtime.Object, error) {
+	var ret []runtime.Object
+	for _, lister := range l.listers {
+		objs, err := lister.ByNamespace(l.namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, objs...)
+	}
+	return ret, nil
+}
+
+func (l multiGenericNamespaceLister) Get(name string) (runtime.Object, error) {
+	for _, lister := range l.listers {
+		obj, err := lister.ByNamespace(l.namespace).Get(name)
+		if err == nil || !errors.IsNotFound(err) {
+			return obj, err
+		}
+	}
+	return nil, errors.NewNotFound(HTTPRouteResource.GroupResource(), name)
+}
@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	listercorev1 "k8s.io/client-go/listers/core/v1"
+	listernetv1 "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newIndexer 返回与informer相同配置的indexer，用于构造lister
+func newIndexer(objs ...interface{}) cache.Indexer {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range objs {
+		indexer.Add(obj)
+	}
+	return indexer
+}
+
+func TestMultiServiceLister(t *testing.T) {
+	service := func(namespace string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: namespace}}
+	}
+	// 每个监听的namespace各有一个lister
+	lister := multiServiceLister{
+		listercorev1.NewServiceLister(newIndexer(service("team-a"))),
+		listercorev1.NewServiceLister(newIndexer(service("team-b"))),
+	}
+
+	if got, err := lister.Services("team-b").Get("test"); err != nil || got.Namespace != "team-b" {
+		t.Errorf("Expected service team-b/test, got %v, %v", got, err)
+	}
+	if _, err := lister.Services("team-c").Get("test"); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound for a namespace outside the scope, got %v", err)
+	}
+	if services, _ := lister.List(labels.Everything()); len(services) != 2 {
+		t.Errorf("Expected 2 services from all listers, got %d", len(services))
+	}
+	if services, _ := lister.Services("team-a").List(labels.Everything()); len(services) != 1 {
+		t.Errorf("Expected 1 service in team-a, got %d", len(services))
+	}
+}
+
+func TestMultiIngressLister(t *testing.T) {
+	ingress := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team-b"}}
+	lister := multiIngressLister{
+		listernetv1.NewIngressLister(newIndexer()),
+		listernetv1.NewIngressLister(newIndexer(ingress)),
+	}
+
+	if got, err := lister.Ingresses("team-b").Get("test"); err != nil || got != ingress {
+		t.Errorf("Expected ingress team-b/test, got %v, %v", got, err)
+	}
+	if _, err := lister.Ingresses("team-a").Get("test"); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
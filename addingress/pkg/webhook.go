@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// WebhookPath validating admission webhook 的路径，ValidatingWebhookConfiguration 中的 clientConfig 需要指向这个路径，
+// rules 只需要匹配 core/v1 services 的 CREATE 和 UPDATE
+const WebhookPath = "/validate-service"
+
+// ServeWebhook 启动 HTTPS 的 validating admission webhook，在 kubectl apply 时拒绝 annotation 不合法的service。
+// 与 syncService 使用相同的校验：host 语法、pathType、service上是否有指定的端口，以及路由是否已经被其它ingress占用。
+// 修改service时，只有声明的路由发生变化才检查冲突，路由被占用的service仍然可以修改其它字段；
+// annotation 在修改前就不合法时，只有修改了 ingress/ 开头的 annotation 才拒绝。
+// 校验没有副作用：不修改workqueue，也不记录事件
+// 依赖informer的缓存，缓存同步完成之前放行所有请求，由控制器在调谐时记录事件。
+// stopCh 关闭后停止
+func (c *controller) ServeWebhook(addr, certFile, keyFile string, stopCh <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WebhookPath, c.serveValidateService)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// serveValidateService 处理 apiserver 发来的 AdmissionReview
+func (c *controller) serveValidateService(w http.ResponseWriter, r *http.Request) {
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "AdmissionReview has no request", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = c.validateService(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	if err := json.NewEncoder(w).Encode(&review); err != nil {
+		klog.ErrorS(err, "Failed to write AdmissionReview response")
+	}
+}
+
+// validateService 校验请求中的service，没有 ingress/http 的service直接放行
+func (c *controller) validateService(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	service := &corev1.Service{}
+	if err := json.Unmarshal(request.Object.Raw, service); err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{Message: fmt.Sprintf("failed to decode Service: %v", err), Code: http.StatusBadRequest},
+		}
+	}
+	if service.Namespace == "" {
+		service.Namespace = request.Namespace
+	}
+	if _, ok := service.Annotations[annoKey]; !ok {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	opts, err := c.parseIngressOptions(service)
+	if err != nil {
+		// 修改前就无法解析、这次也没有修改相关 annotation 的service（比如只修改了 label 或端口），放行并返回警告，
+		// 已有的不合法annotation不应该阻塞与路由无关的修改
+		if request.Operation == admissionv1.Update && !c.introducesParseError(request, service) {
+			return &admissionv1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: []string{fmt.Sprintf("addingress annotations are invalid: %v", err)},
+			}
+		}
+		return denied(err.Error())
+	}
+	// 路由冲突只针对 ingress 后端，检测依赖缓存
+	if c.backendName(opts) != backendIngress {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	if request.Operation == admissionv1.Update && !c.routesChanged(request, opts) {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	if !c.HasSynced() {
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{"addingress caches are not synced yet, route collisions were not checked"},
+		}
+	}
+	conflict, route, _, err := c.findRouteConflict(service, opts)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{fmt.Sprintf("addingress failed to check route collisions: %v", err)},
+		}
+	}
+	if conflict != nil {
+		return denied(fmt.Sprintf("route %s is already claimed by Ingress %s/%s", route, conflict.Namespace, conflict.Name))
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+// routesChanged 比较修改前后的service声明的 host+path，修改前的service无法解析时视为发生了变化
+func (c *controller) routesChanged(request *admissionv1.AdmissionRequest, opts *ingressOptions) bool {
+	old := &corev1.Service{}
+	if err := json.Unmarshal(request.OldObject.Raw, old); err != nil {
+		return true
+	}
+	if old.Namespace == "" {
+		old.Namespace = request.Namespace
+	}
+	if _, ok := old.Annotations[annoKey]; !ok {
+		return true
+	}
+	oldOpts, err := c.parseIngressOptions(old)
+	if err != nil || c.backendName(oldOpts) != backendIngress {
+		return true
+	}
+	return !reflect.DeepEqual(serviceRoutes(oldOpts), serviceRoutes(opts))
+}
+
+// introducesParseError 修改后的service无法解析时，判断是否由这次修改引起：修改前的service能够解析，
+// 或者修改了影响解析的 annotation 时返回 true。修改前的service无法解码时也返回 true
+func (c *controller) introducesParseError(request *admissionv1.AdmissionRequest, service *corev1.Service) bool {
+	old := &corev1.Service{}
+	if err := json.Unmarshal(request.OldObject.Raw, old); err != nil {
+		return true
+	}
+	if old.Namespace == "" {
+		old.Namespace = request.Namespace
+	}
+	if _, ok := old.Annotations[annoKey]; !ok {
+		return true
+	}
+	if _, err := c.parseIngressOptions(old); err == nil {
+		return true
+	}
+	return !reflect.DeepEqual(c.ingressAnnotations(old), c.ingressAnnotations(service))
+}
+
+// ingressAnnotations 返回service上影响解析结果的 annotation：ingress/ 开头的 annotation（控制器写入的除外），
+// 以及 --annotation-prefix 开头的 annotation
+func (c *controller) ingressAnnotations(service *corev1.Service) map[string]string {
+	annotations := map[string]string{}
+	for key, value := range service.Annotations {
+		switch key {
+		case annoURL, annoLoadBalancer, annoConflict:
+			continue
+		}
+		if strings.HasPrefix(key, "ingress/") || (c.opts.AnnotationPrefix != "" && strings.HasPrefix(key, c.opts.AnnotationPrefix)) {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// denied 拒绝请求的响应
+func denied(message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	listernetv1 "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newWebhookController 返回缓存中有 existing 的控制器，用于检测路由冲突
+func newWebhookController(existing ...interface{}) *controller {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		indexHostPath:        hostPathIndexFunc,
+	})
+	for _, obj := range existing {
+		indexer.Add(obj)
+	}
+	c := newQueueController()
+	c.ingressLister = listernetv1.NewIngressLister(indexer)
+	c.ingressIndexers = []cache.Indexer{indexer}
+	return c
+}
+
+// admissionRequest 返回创建 service 的 AdmissionRequest
+func admissionRequest(service *corev1.Service) *admissionv1.AdmissionRequest {
+	request := &admissionv1.AdmissionRequest{UID: types.UID("request-uid"), Operation: admissionv1.Create, Namespace: service.Namespace}
+	request.Object.Raw, _ = json.Marshal(service)
+	return request
+}
+
+func TestValidateService(t *testing.T) {
+	owner := hostPathService("owner", "team-a")
+	existing := managedIngress("owner", owner, "example.com", "/")
+	existing.Namespace = owner.Namespace
+	c := newWebhookController(existing)
+
+	invalid := hostPathService("invalid", "team-b")
+	invalid.Annotations[annoPathType] = "Regex"
+	ignored := hostPathService("ignored", "team-b")
+	delete(ignored.Annotations, annoKey)
+	ignored.Annotations[annoPathType] = "Regex"
+	free := hostPathService("free", "team-b")
+	free.Annotations[annoHost] = "free.example.com"
+
+	tests := []struct {
+		name    string
+		service *corev1.Service
+		allowed bool
+	}{
+		{name: "without ingress/http", service: ignored, allowed: true},
+		{name: "invalid annotation", service: invalid},
+		{name: "claimed route", service: hostPathService("late", "team-b")},
+		{name: "free route", service: free, allowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := c.validateService(admissionRequest(test.service))
+			if response.Allowed != test.allowed {
+				t.Errorf("Expected allowed %v, got %+v", test.allowed, response.Result)
+			}
+		})
+	}
+
+	// 缓存没有同步完成时放行，并返回警告
+	c.synced = []cache.InformerSynced{func() bool { return false }}
+	response := c.validateService(admissionRequest(hostPathService("late", "team-b")))
+	if !response.Allowed || len(response.Warnings) == 0 {
+		t.Errorf("Expected the request to be allowed with a warning before caches synced, got %+v", response)
+	}
+}
+
+func TestValidateServiceUpdateWithInvalidAnnotations(t *testing.T) {
+	c := newWebhookController()
+	valid := hostPathService("test", "default")
+	invalid := valid.DeepCopy()
+	invalid.Annotations[annoPathType] = "Regex"
+
+	relabeled := invalid.DeepCopy()
+	relabeled.Labels = map[string]string{"team": "payments"}
+	withURL := invalid.DeepCopy()
+	withURL.Annotations[annoURL] = "http://example.com/"
+	stillInvalid := invalid.DeepCopy()
+	stillInvalid.Annotations[annoPathType] = "Glob"
+
+	tests := []struct {
+		name     string
+		old      *corev1.Service
+		service  *corev1.Service
+		allowed  bool
+		warnings bool
+	}{
+		{name: "annotation made invalid", old: valid, service: invalid},
+		{name: "already invalid, labels changed", old: invalid, service: relabeled, allowed: true, warnings: true},
+		{name: "already invalid, controller annotation changed", old: invalid, service: withURL, allowed: true, warnings: true},
+		{name: "already invalid, ingress annotation changed", old: invalid, service: stillInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := admissionRequest(test.service)
+			request.Operation = admissionv1.Update
+			request.OldObject.Raw, _ = json.Marshal(test.old)
+			response := c.validateService(request)
+			if response.Allowed != test.allowed || (len(response.Warnings) != 0) != test.warnings {
+				t.Errorf("Expected allowed %v with warnings %v, got %+v", test.allowed, test.warnings, response)
+			}
+		})
+	}
+}
+
+func TestServeValidateService(t *testing.T) {
+	c := newWebhookController()
+	body, _ := json.Marshal(&admissionv1.AdmissionReview{Request: admissionRequest(hostPathService("test", "default"))})
+	recorder := httptest.NewRecorder()
+	c.serveValidateService(recorder, httptest.NewRequest(http.MethodPost, WebhookPath, bytes.NewReader(body)))
+
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(recorder.Body).Decode(&review); err != nil {
+		t.Fatalf("Unexpected error decoding response: %v", err)
+	}
+	if review.Response == nil || review.Response.UID != "request-uid" || !review.Response.Allowed {
+		t.Errorf("Expected an allowed response for request-uid, got %+v", review.Response)
+	}
+	if review.Request != nil {
+		t.Errorf("Expected the request to be removed from the response")
+	}
+
+	recorder = httptest.NewRecorder()
+	c.serveValidateService(recorder, httptest.NewRequest(http.MethodPost, WebhookPath, bytes.NewReader([]byte("{}"))))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a review without request, got %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestWebhookChecksConflictsOnlyWhenRoutesChange(t *testing.T) {
+	f := newFixture(t)
+	owner := newService("owner", map[string]string{annoKey: "true", annoHost: "example.com"})
+	f.ingressLister = append(f.ingressLister, managedIngress("owner", owner, "example.com", "/"))
+	c, _ := f.newController()
+	// 测试中没有启动informer，视为缓存已经同步
+	c.synced = nil
+
+	request := func(operation admissionv1.Operation, old, service *corev1.Service) *admissionv1.AdmissionRequest {
+		request := &admissionv1.AdmissionRequest{Operation: operation, Namespace: service.Namespace}
+		request.Object.Raw, _ = json.Marshal(service)
+		if old != nil {
+			request.OldObject.Raw, _ = json.Marshal(old)
+		}
+		return request
+	}
+	late := newService("late", map[string]string{annoKey: "true", annoHost: "example.com"})
+	if response := c.validateService(request(admissionv1.Create, nil, late)); response.Allowed {
+		t.Errorf("Expected creating a Service with a claimed route to be denied")
+	}
+
+	relabeled := late.DeepCopy()
+	relabeled.Labels = map[string]string{"team": "payments"}
+	if response := c.validateService(request(admissionv1.Update, late, relabeled)); !response.Allowed {
+		t.Errorf("Expected updating a Service without changing its routes to be allowed, got %v", response.Result)
+	}
+
+	moved := newService("late", map[string]string{annoKey: "true", annoHost: "other.example.com"})
+	if response := c.validateService(request(admissionv1.Update, moved, late)); response.Allowed {
+		t.Errorf("Expected moving a Service onto a claimed route to be denied")
+	}
+
+	if c.queue.Len() != 0 {
+		t.Errorf("Expected the webhook not to enqueue keys, got %d", c.queue.Len())
+	}
+	select {
+	case event := <-f.recorder.Events:
+		t.Errorf("Expected the webhook not to record events, got %q", event)
+	default:
+	}
+}
@@ -4,10 +4,12 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:subresource:status
 
 // App is the Schema for the apps API
 type App struct {
@@ -24,23 +26,111 @@ type AppSpec struct {
 	ServiceSpec    ServiceTemplate    `json:"serviceTemplate,omitempty"`
 }
 
+// +kubebuilder:validation:XValidation:rule="has(self.image) || has(self.template)",message="either image or template must be set"
 type DeploymentTemplate struct {
-	Name     string `json:"name"`
-	Image    string `json:"image"`
+	Name string `json:"name"`
+	// Image of the container created when Template has no containers,
+	// and the default image of the containers in Template that do not set one.
+	// +optional
+	Image    string `json:"image,omitempty"`
 	Replicas int32  `json:"replicas"`
+	// Template of the Pods created by the Deployment. The controller adds the App's labels,
+	// which must not be overridden, and a container named app-deploy-container when it has no spec.
+	// The schema of the template is generated without field descriptions to keep the CRD
+	// under the size limit of client-side kubectl apply.
+	// +optional
+	Template *corev1.PodTemplateSpec `json:"template,omitempty"`
 }
 
+// +kubebuilder:validation:XValidation:rule="!has(self.ports) || size(self.ports) <= 1 || self.ports.all(p, has(p.name) && size(p.name) > 0)",message="ports must be named when there is more than one port"
+// +kubebuilder:validation:XValidation:rule="!has(self.ports) || (has(self.type) && self.type in ['NodePort', 'LoadBalancer']) || self.ports.all(p, !has(p.nodePort))",message="nodePort may only be set when type is NodePort or LoadBalancer"
 type ServiceTemplate struct {
 	Name string `json:"name"`
+	// Type determines how the Service is exposed. Headless creates a ClusterIP Service
+	// with clusterIP None. Switching to or from Headless re-creates the Service.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer;Headless
+	// +kubebuilder:default=ClusterIP
+	// +optional
+	Type ServiceType `json:"type,omitempty"`
+	// Ports exposed by the Service. Defaults to a single port 8080 named app-service.
+	// +listType=map
+	// +listMapKey=port
+	// +listMapKey=protocol
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	Ports []ServicePort `json:"ports,omitempty"`
+	// SessionAffinity is None or ClientIP, None by default.
+	// +kubebuilder:validation:Enum=None;ClientIP
+	// +optional
+	SessionAffinity corev1.ServiceAffinity `json:"sessionAffinity,omitempty"`
+}
+
+// ServiceType is the type of the Service created for an App.
+type ServiceType string
+
+const (
+	ServiceTypeClusterIP    ServiceType = "ClusterIP"
+	ServiceTypeNodePort     ServiceType = "NodePort"
+	ServiceTypeLoadBalancer ServiceType = "LoadBalancer"
+	ServiceTypeHeadless     ServiceType = "Headless"
+)
+
+// ServicePort is a port exposed by the Service of an App.
+type ServicePort struct {
+	// Name of the port, required when there is more than one port.
+	// +kubebuilder:validation:MaxLength=63
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Port exposed by the Service.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+	// TargetPort is the number or name of the port on the Pods, the same as Port by default.
+	// +optional
+	TargetPort intstr.IntOrString `json:"targetPort,omitempty"`
+	// Protocol of the port, TCP by default.
+	// +kubebuilder:validation:Enum=TCP;UDP;SCTP
+	// +kubebuilder:default=TCP
+	// +optional
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+	// NodePort on which the port is exposed when Type is NodePort or LoadBalancer.
+	// Allocated by the apiserver when not set.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	NodePort int32 `json:"nodePort,omitempty"`
 }
 
 // AppStatus defines the observed state of App.
 // It should always be reconstructable from the state of the cluster and/or outside world.
 type AppStatus struct {
+	// ObservedGeneration is the most recent generation of the App observed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions represent the latest available observations of the App's state,
+	// computed from its Deployment and Service.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	// +patchStrategy=merge
+	// +patchMergeKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
 	DeploymentStatus *appsv1.DeploymentStatus `json:"deploymentStatus,omitempty"`
 	ServiceStatus    *corev1.ServiceStatus    `json:"serviceStatus,omitempty"`
 }
 
+// Condition types of an App.
+const (
+	// AppReady means the Deployment has all its replicas available and the Service is exposed.
+	AppReady = "Ready"
+	// AppProgressing means the Deployment is rolling out a new revision or scaling.
+	AppProgressing = "Progressing"
+	// AppDegraded means the App cannot reach its desired state without intervention,
+	// e.g. its Deployment exceeded its progress deadline or a child resource is not managed by the App.
+	AppDegraded = "Degraded"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // AppList contains a list of App
@@ -8,11 +8,16 @@ import (
 	informersv1 "crd-controller-demo/pkg/generated/informers/externalversions/appcontroller/v1"
 	listerv1 "crd-controller-demo/pkg/generated/listers/appcontroller/v1"
 	"crd-controller-demo/pkg/utils"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	appsinformersv1 "k8s.io/client-go/informers/apps/v1"
@@ -26,6 +31,8 @@ import (
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -96,12 +103,15 @@ func NewController(kubeclientset kubernetes.Interface,
 	})
 
 	// 为 DeploymentInformer，设置 ResourceEventHandler
+	// deployment 的 status 变化时，重新计算 app 的 conditions
 	deploymentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.UpdateDeployment,
 		DeleteFunc: c.DeleteDeployment,
 	})
 
 	// 为 ServiceInformer，设置 ResourceEventHandler
 	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.UpdateService,
 		DeleteFunc: c.DeleteService,
 	})
 
@@ -131,22 +141,50 @@ func (c *Controller) UpdateApp(oldObj, newObj interface{}) {
 	c.enqueue(newObj)
 }
 
-func (c *Controller) DeleteDeployment(obj interface{}) {
-	deploy := obj.(*appsv1.Deployment)
-	ownerReference := metav1.GetControllerOf(deploy)
-	if ownerReference == nil || ownerReference.Kind != "App" {
+func (c *Controller) UpdateDeployment(oldObj, newObj interface{}) {
+	oldDeploy := oldObj.(*appsv1.Deployment)
+	newDeploy := newObj.(*appsv1.Deployment)
+	// 只有 spec（generation）、status 变化，或者 labels 被修改时才需要处理；
+	// informer 定期 resync、deployment controller 修改 revision annotation 等都不需要重新调谐
+	if oldDeploy.Generation == newDeploy.Generation && reflect.DeepEqual(oldDeploy.Labels, newDeploy.Labels) &&
+		equality.Semantic.DeepEqual(oldDeploy.Status, newDeploy.Status) {
 		return
 	}
-	c.enqueue(obj)
+	c.enqueueOwner(newObj)
+}
+
+func (c *Controller) UpdateService(oldObj, newObj interface{}) {
+	if oldObj.(*corev1.Service).ResourceVersion == newObj.(*corev1.Service).ResourceVersion {
+		return
+	}
+	c.enqueueOwner(newObj)
+}
+
+func (c *Controller) DeleteDeployment(obj interface{}) {
+	c.enqueueOwner(obj)
 }
 
 func (c *Controller) DeleteService(obj interface{}) {
-	service := obj.(*corev1.Service)
-	ownerReference := metav1.GetControllerOf(service)
+	c.enqueueOwner(obj)
+}
+
+// enqueueOwner 将 deployment、service 所属的 app 加入队列。
+// 队列中的 key 是 app 的 key，deployment、service 的名称与 app 不一定相同
+func (c *Controller) enqueueOwner(obj interface{}) {
+	// informer 错过了删除事件时，拿到的是 DeletedFinalStateUnknown
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type %T", obj))
+		return
+	}
+	ownerReference := metav1.GetControllerOf(object)
 	if ownerReference == nil || ownerReference.Kind != "App" {
 		return
 	}
-	c.enqueue(obj)
+	c.workqueue.Add(object.GetNamespace() + "/" + ownerReference.Name)
 }
 
 func (c *Controller) Run(workerNum int, stopCh <-chan struct{}) error {
@@ -223,83 +261,155 @@ func (c *Controller) syncApp(key string) error {
 		}
 		return err
 	}
+	// 不能直接修改 informer 缓存中的对象
+	app = app.DeepCopy()
+
+	// 处理 deploymentSpec、serviceSpec，出错时也要将错误记录到 AppStatus 的 condition 中
+	deploy, deployChanged, syncErr := c.syncDeployment(app)
+	var service *corev1.Service
+	var serviceChanged bool
+	if syncErr == nil {
+		// 临时的 deployment 可用之前，service 继续选中旧的 pod
+		migrating := deploy != nil && deploy.Name != app.Spec.DeploymentSpec.Name && !rolloutComplete(deploy)
+		service, serviceChanged, syncErr = c.syncService(app, migrating)
+	}
+
+	// 将 AppStatus 通过 status 子资源更新到环境中去，没有变化时不更新
+	if err := c.updateAppStatus(app, deploy, service, syncErr); err != nil {
+		return fmt.Errorf("failed to update status of app [%s], error: [%v]", key, err)
+	}
+	if syncErr != nil {
+		return syncErr
+	}
+
+	// 只有创建、修改或重建了资源时才记录事件，deployment、service 的 status 变化触发的调谐不记录
+	if deployChanged || serviceChanged {
+		c.recorder.Event(app, corev1.EventTypeNormal, utils.SuccessSynced, utils.MessageResourceSynced)
+	}
 
+	return nil
+}
+
+// syncDeployment 调谐 app 的 deployment，返回调谐后的 deployment，以及是否创建、修改或重建了 deployment。
+// app 没有设置 deploymentTemplate 时返回 nil；迁移 selector 时返回临时的 deployment
+func (c *Controller) syncDeployment(app *appcontrollerv1.App) (*appsv1.Deployment, bool, error) {
+	namespace := app.Namespace
 	// 取出 app 对象 的 deploymentSpec 部分
 	deploymentTemplate := app.Spec.DeploymentSpec
-	// 如果 app 的 deploymentTemplate 不为空
-	if deploymentTemplate.Name != "" {
-		// 尝试从缓存获取 对应的 deployment
-		deploy, err := c.deploymentsLister.Deployments(namespace).Get(deploymentTemplate.Name)
-		if err != nil {
-			// 如果没找到
-			if errors.IsNotFound(err) {
-				klog.V(4).Info("starting to create deployment [%s] in namespace [%s]", deploymentTemplate.Name, namespace)
-				// 创建一个deployment对象，然后使用 kubeClientset，与apiserver交互，创建deployment
-				deploy = newDeployment(deploymentTemplate, app)
-				_, err := c.kubeClientset.AppsV1().Deployments(namespace).Create(context.TODO(), deploy, metav1.CreateOptions{})
-				if err != nil {
-					return fmt.Errorf("failed to create deployment [%s] in namespace [%s], error: [%v]", deploymentTemplate.Name, namespace, err)
-				}
-				// 创建完成后，从apiserver中，获取最新的deployment，因为下面要使用它的status.【这里不能从informer缓存获取，因为缓存里暂时未同步新创建的deployment】
-				deploy, _ = c.kubeClientset.AppsV1().Deployments(namespace).Get(context.TODO(), deploymentTemplate.Name, metav1.GetOptions{})
-			} else {
-				return fmt.Errorf("failed to get deployment [%s] in namespace [%s], error: [%v]", deploy.Name, deploy.Namespace, err)
-			}
-		}
-		// 如果获取到的 deployment，并非 app 所控制，报错
-		if !metav1.IsControlledBy(deploy, app) {
-			msg := fmt.Sprintf(utils.MessageResourceExists, deploy.Name)
-			c.recorder.Event(app, corev1.EventTypeWarning, utils.ErrResourceExists, msg)
-			return fmt.Errorf("%s", msg)
-		}
-		// update deploy status
-		app.Status.DeploymentStatus = &deploy.Status
+	// 如果 app 的 deploymentTemplate 为空，不需要 deployment
+	if deploymentTemplate.Name == "" {
+		return nil, false, nil
 	}
 
-	// 取出 app 对象 的 deploymentSpec 部分
-	serviceTemplate := app.Spec.ServiceSpec
-	// 如果 app 的 serviceTemplate 不为空
-	if serviceTemplate.Name != "" {
-		// 尝试从缓存获取 对应的 service
-		service, err := c.servicesLister.Services(namespace).Get(serviceTemplate.Name)
-		if err != nil {
-			// 如果没找到
-			if errors.IsNotFound(err) {
-				klog.V(4).Info("starting to create service [%s] in namespace [%s]", serviceTemplate.Name, namespace)
-				// 创建一个service对象，然后使用 kubeClientset，与apiserver交互，创建service
-				service = newService(serviceTemplate, app)
-				_, err := c.kubeClientset.CoreV1().Services(namespace).Create(context.TODO(), service, metav1.CreateOptions{})
-				if err != nil {
-					return fmt.Errorf("failed to create service [%s] in namespace [%s], error: [%v]", serviceTemplate.Name, namespace, err)
-				}
-				// 创建完成后，从apiserver中，获取最新的service，因为下面要使用它的status.【这里不能从informer缓存获取，因为缓存里暂时未同步新创建的service】
-				service, _ = c.kubeClientset.CoreV1().Services(namespace).Get(context.TODO(), serviceTemplate.Name, metav1.GetOptions{})
-			} else {
-				return fmt.Errorf("failed to get service [%s] in namespace [%s], error: [%v]", service.Name, service.Namespace, err)
+	// modified 是否创建或修改了 deployment
+	modified := false
+	// 尝试从缓存获取 对应的 deployment
+	deploy, err := c.deploymentsLister.Deployments(namespace).Get(deploymentTemplate.Name)
+	if err != nil {
+		// 如果没找到
+		if errors.IsNotFound(err) {
+			klog.V(4).Infof("starting to create deployment [%s] in namespace [%s]", deploymentTemplate.Name, namespace)
+			// 创建一个deployment对象，然后使用 kubeClientset，与apiserver交互，创建deployment。
+			// 使用apiserver返回的deployment，因为下面要使用它的status.【这里不能从informer缓存获取，因为缓存里暂时未同步新创建的deployment】
+			deploy, err = c.kubeClientset.AppsV1().Deployments(namespace).Create(context.TODO(), newDeployment(deploymentTemplate, app), metav1.CreateOptions{})
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to create deployment [%s] in namespace [%s], error: [%v]", deploymentTemplate.Name, namespace, err)
 			}
+			modified = true
+		} else {
+			return nil, false, fmt.Errorf("failed to get deployment [%s] in namespace [%s], error: [%v]", deploymentTemplate.Name, namespace, err)
 		}
-		// 如果获取到的 service，并非 app 所控制，报错
-		if !metav1.IsControlledBy(service, app) {
-			msg := fmt.Sprintf(utils.MessageResourceExists, service.Name)
-			c.recorder.Event(app, corev1.EventTypeWarning, utils.ErrResourceExists, msg)
-			return fmt.Errorf("%s", msg)
+	}
+	// 如果获取到的 deployment，并非 app 所控制，报错
+	if !metav1.IsControlledBy(deploy, app) {
+		msg := fmt.Sprintf(utils.MessageResourceExists, deploy.Name)
+		c.recorder.Event(app, corev1.EventTypeWarning, utils.ErrResourceExists, msg)
+		return nil, false, fmt.Errorf("%s", msg)
+	}
+	desired := newDeployment(deploymentTemplate, app)
+	// deployment 的 selector 不能修改，selector 与期望的不一致（比如由旧版本控制器使用 app-key: app-value 创建）时，
+	// 先用临时的 deployment 接管流量，再删除重建，见 migrateDeployment
+	if selectorChanged(deploy, desired) {
+		return c.migrateDeployment(app, deploy, desired)
+	}
+	// 如果 deployment 与 app 中期望的不一致（比如修改了 image 或 replicas），只更新不一致的字段
+	if updated, changed := deploymentChanges(deploy, desired); len(changed) != 0 {
+		klog.V(4).Infof("starting to update deployment [%s] in namespace [%s], changed: %v", deploy.Name, namespace, changed)
+		deploy, err = c.kubeClientset.AppsV1().Deployments(namespace).Update(context.TODO(), updated, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to update deployment [%s] in namespace [%s], error: [%v]", updated.Name, namespace, err)
 		}
-		// update service status
-		app.Status.ServiceStatus = &service.Status
+		modified = true
+		c.recorder.Eventf(app, corev1.EventTypeNormal, utils.DeploymentUpdated, utils.MessageDeploymentUpdated, deploy.Name, strings.Join(changed, ", "))
 	}
-
-	// 处理完 deploymentSpec、serviceSpec，将设置好的AppStatus更新到环境中去
-	_, err = c.appClientset.AppcontrollerV1().Apps(namespace).Update(context.TODO(), app, metav1.UpdateOptions{})
+	// 重建的 deployment 可用后，删除迁移时创建的临时 deployment
+	deleted, err := c.finishMigration(app, deploy)
 	if err != nil {
-		return fmt.Errorf("failed to update app [%s], error: [%v]", key, err)
+		return nil, false, err
 	}
+	return deploy, modified || deleted, nil
+}
 
-	// 记录事件日志
-	c.recorder.Event(app, corev1.EventTypeNormal, utils.SuccessSynced, utils.MessageResourceSynced)
+// syncService 调谐 app 的 service，返回调谐后的 service，以及是否创建、修改或重建了 service。
+// app 没有设置 serviceTemplate，或者 service 正在重建时，返回 nil。keepSelector 为 true 时不修改已有 service 的 selector
+func (c *Controller) syncService(app *appcontrollerv1.App, keepSelector bool) (*corev1.Service, bool, error) {
+	namespace := app.Namespace
+	// 取出 app 对象 的 serviceSpec 部分
+	serviceTemplate := app.Spec.ServiceSpec
+	// 如果 app 的 serviceTemplate 为空，不需要 service
+	if serviceTemplate.Name == "" {
+		return nil, false, nil
+	}
 
-	return nil
+	// modified 是否创建或修改了 service
+	modified := false
+	// 尝试从缓存获取 对应的 service
+	service, err := c.servicesLister.Services(namespace).Get(serviceTemplate.Name)
+	if err != nil {
+		// 如果没找到
+		if errors.IsNotFound(err) {
+			klog.V(4).Infof("starting to create service [%s] in namespace [%s]", serviceTemplate.Name, namespace)
+			// 创建一个service对象，然后使用 kubeClientset，与apiserver交互，创建service。
+			// 使用apiserver返回的service，因为下面要使用它的status.【这里不能从informer缓存获取，因为缓存里暂时未同步新创建的service】
+			service, err = c.kubeClientset.CoreV1().Services(namespace).Create(context.TODO(), newService(serviceTemplate, app), metav1.CreateOptions{})
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to create service [%s] in namespace [%s], error: [%v]", serviceTemplate.Name, namespace, err)
+			}
+			modified = true
+		} else {
+			return nil, false, fmt.Errorf("failed to get service [%s] in namespace [%s], error: [%v]", serviceTemplate.Name, namespace, err)
+		}
+	}
+	// 如果获取到的 service，并非 app 所控制，报错
+	if !metav1.IsControlledBy(service, app) {
+		msg := fmt.Sprintf(utils.MessageResourceExists, service.Name)
+		c.recorder.Event(app, corev1.EventTypeWarning, utils.ErrResourceExists, msg)
+		return nil, false, fmt.Errorf("%s", msg)
+	}
+	desired := newService(serviceTemplate, app)
+	if keepSelector {
+		desired.Spec.Selector = service.Spec.Selector
+	}
+	// service 的 clusterIP 不能修改，在 Headless 和其它类型之间切换时，删除后由 DeleteService 将 app 重新加入队列，下次调谐时重建
+	if isHeadless(service) != isHeadless(desired) {
+		return nil, true, c.recreateService(app, service)
+	}
+	// 如果 service 与 app 中期望的不一致，只更新不一致的字段
+	if updated, changed := serviceChanges(service, desired); len(changed) != 0 {
+		klog.V(4).Infof("starting to update service [%s] in namespace [%s], changed: %v", service.Name, namespace, changed)
+		service, err = c.kubeClientset.CoreV1().Services(namespace).Update(context.TODO(), updated, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to update service [%s] in namespace [%s], error: [%v]", updated.Name, namespace, err)
+		}
+		modified = true
+		c.recorder.Eventf(app, corev1.EventTypeNormal, utils.ServiceUpdated, utils.MessageServiceUpdated, service.Name, strings.Join(changed, ", "))
+	}
+	return service, modified, nil
 }
 
+// defaultContainerName app 中的 pod 模板没有容器时，创建的容器的名称
+const defaultContainerName = "app-deploy-container"
+
 // newDeployment 创建一个deployment对象
 func newDeployment(template appcontrollerv1.DeploymentTemplate, app *appcontrollerv1.App) *appsv1.Deployment {
 	d := &appsv1.Deployment{
@@ -308,34 +418,22 @@ func newDeployment(template appcontrollerv1.DeploymentTemplate, app *appcontroll
 			APIVersion: "apps/v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: template.Name,
+			Name:   template.Name,
+			Labels: appLabels(app),
 		},
 		Spec: appsv1.DeploymentSpec{
-			// Selector 和 pod 的 Labels 必须一致
+			// Selector 和 pod 的 Labels 必须一致，selector 由 app 决定，创建后不能修改
 			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app-key": "app-value",
-				},
+				MatchLabels: selectorLabels(app),
 			},
 			Replicas: &template.Replicas,
-			Template: corev1.PodTemplateSpec{
-				// pod 的 labels，没有让用户指定，这里设置成默认的
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app-key": "app-value",
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "app-deploy-container",
-							Image: template.Image,
-						},
-					},
-				},
-			},
+			Template: podTemplate(template, app),
 		},
 	}
+	// 记录 pod 模板的 hash，用于判断 app 中的模板是否修改过
+	d.Annotations = map[string]string{
+		annoTemplateHash: templateHash(&d.Spec.Template),
+	}
 	// 将 deploy 的 OwnerReferences，设置成app
 	d.OwnerReferences = []metav1.OwnerReference{
 		*metav1.NewControllerRef(app, appcontrollerv1.SchemeGroupVersion.WithKind("App")),
@@ -343,6 +441,39 @@ func newDeployment(template appcontrollerv1.DeploymentTemplate, app *appcontroll
 	return d
 }
 
+// podTemplate 在 app 中的 pod 模板上合并默认值：pod 的 labels 加上 app 的 labels；
+// 没有容器时，创建一个使用 app 中 image 的容器；没有设置 image 的容器，使用 app 中的 image
+func podTemplate(template appcontrollerv1.DeploymentTemplate, app *appcontrollerv1.App) corev1.PodTemplateSpec {
+	var pod corev1.PodTemplateSpec
+	if template.Template != nil {
+		template.Template.DeepCopyInto(&pod)
+	}
+	// selector 依赖 app 的 labels，用户设置的同名 label 会被覆盖
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	for k, v := range appLabels(app) {
+		pod.Labels[k] = v
+	}
+	if len(pod.Spec.Containers) == 0 {
+		pod.Spec.Containers = []corev1.Container{{Name: defaultContainerName}}
+	}
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Image == "" {
+			pod.Spec.Containers[i].Image = template.Image
+		}
+	}
+	return pod
+}
+
+// templateHash 计算 pod 模板的 hash
+func templateHash(template *corev1.PodTemplateSpec) string {
+	hasher := fnv.New32a()
+	data, _ := json.Marshal(template)
+	hasher.Write(data)
+	return strconv.FormatUint(uint64(hasher.Sum32()), 16)
+}
+
 func newService(template appcontrollerv1.ServiceTemplate, app *appcontrollerv1.App) *corev1.Service {
 	s := &corev1.Service{
 		TypeMeta: metav1.TypeMeta{
@@ -350,22 +481,26 @@ func newService(template appcontrollerv1.ServiceTemplate, app *appcontrollerv1.A
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: template.Name,
+			Name:   template.Name,
+			Labels: appLabels(app),
 		},
 		Spec: corev1.ServiceSpec{
-			// Selector 和 pod 的 Labels 必须一致
-			Selector: map[string]string{
-				"app-key": "app-value",
-			},
-			Ports: []corev1.ServicePort{
-				{
-					Name: "app-service",
-					// Service的端口，默认设置成了8080。这里仅仅是为了学习crd，实际开发中可以设置到AppSpec中去
-					Port: 8080,
-				},
-			},
+			// Selector 和 pod 的 Labels 必须一致，只选中这个 app 的 pod
+			Selector:        selectorLabels(app),
+			Type:            corev1.ServiceTypeClusterIP,
+			Ports:           servicePorts(template.Ports),
+			SessionAffinity: corev1.ServiceAffinityNone,
 		},
 	}
+	switch template.Type {
+	case appcontrollerv1.ServiceTypeNodePort, appcontrollerv1.ServiceTypeLoadBalancer:
+		s.Spec.Type = corev1.ServiceType(template.Type)
+	case appcontrollerv1.ServiceTypeHeadless:
+		s.Spec.ClusterIP = corev1.ClusterIPNone
+	}
+	if template.SessionAffinity != "" {
+		s.Spec.SessionAffinity = template.SessionAffinity
+	}
 
 	s.OwnerReferences = []metav1.OwnerReference{
 		*metav1.NewControllerRef(app, appcontrollerv1.SchemeGroupVersion.WithKind("App")),
@@ -373,6 +508,153 @@ func newService(template appcontrollerv1.ServiceTemplate, app *appcontrollerv1.A
 	return s
 }
 
+// servicePorts 将 app 中的端口转换为 service 的端口，并填充 protocol、targetPort 的默认值。
+// 没有设置端口时，默认暴露 8080 端口
+func servicePorts(ports []appcontrollerv1.ServicePort) []corev1.ServicePort {
+	if len(ports) == 0 {
+		ports = []appcontrollerv1.ServicePort{{Name: "app-service", Port: 8080}}
+	}
+	servicePorts := make([]corev1.ServicePort, 0, len(ports))
+	for _, port := range ports {
+		servicePort := corev1.ServicePort{
+			Name:       port.Name,
+			Port:       port.Port,
+			Protocol:   port.Protocol,
+			TargetPort: port.TargetPort,
+			NodePort:   port.NodePort,
+		}
+		if servicePort.Protocol == "" {
+			servicePort.Protocol = corev1.ProtocolTCP
+		}
+		if servicePort.TargetPort == (intstr.IntOrString{}) {
+			servicePort.TargetPort = intstr.FromInt32(port.Port)
+		}
+		servicePorts = append(servicePorts, servicePort)
+	}
+	return servicePorts
+}
+
+// isHeadless service 的 clusterIP 为 None
+func isHeadless(service *corev1.Service) bool {
+	return service.Spec.ClusterIP == corev1.ClusterIPNone
+}
+
+// migrationName 迁移 selector 时，临时 deployment 的名称
+func migrationName(name string) string {
+	return name + "-migration"
+}
+
+// migrateDeployment 将 selector 与 app 不一致的 deployment 迁移到新的 selector，迁移过程中始终有可用的 pod：
+//  1. 按新的 selector 加上 labelMigration 创建临时的 deployment，app 的模板变化时同步更新；
+//  2. 临时的 deployment 可用、service 已经选中新的 pod 后，删除旧的 deployment；
+//  3. 下次调谐时按新的 selector 重建 deployment，可用后由 finishMigration 删除临时的 deployment。
+//
+// 返回临时的 deployment，用于计算 app 的 status
+func (c *Controller) migrateDeployment(app *appcontrollerv1.App, old, desired *appsv1.Deployment) (*appsv1.Deployment, bool, error) {
+	desired = desired.DeepCopy()
+	desired.Name = migrationName(old.Name)
+	// selector 多一个 label，与重建的 deployment 的 selector 不同。service 的 selector 仍然能选中临时的 pod
+	desired.Spec.Selector.MatchLabels[labelMigration] = "true"
+	desired.Spec.Template.Labels[labelMigration] = "true"
+	temp, err := c.deploymentsLister.Deployments(old.Namespace).Get(desired.Name)
+	if errors.IsNotFound(err) {
+		klog.V(4).Infof("starting to create deployment [%s] in namespace [%s] to migrate [%s]", desired.Name, old.Namespace, old.Name)
+		temp, err = c.kubeClientset.AppsV1().Deployments(old.Namespace).Create(context.TODO(), desired, metav1.CreateOptions{})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to create deployment [%s] in namespace [%s], error: [%v]", desired.Name, old.Namespace, err)
+		}
+		c.recorder.Eventf(app, corev1.EventTypeNormal, utils.DeploymentMigrating, utils.MessageDeploymentMigrating, old.Name, temp.Name)
+		return temp, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get deployment [%s] in namespace [%s], error: [%v]", desired.Name, old.Namespace, err)
+	}
+	if !metav1.IsControlledBy(temp, app) {
+		msg := fmt.Sprintf(utils.MessageResourceExists, temp.Name)
+		c.recorder.Event(app, corev1.EventTypeWarning, utils.ErrResourceExists, msg)
+		return nil, false, fmt.Errorf("%s", msg)
+	}
+	if updated, changed := deploymentChanges(temp, desired); len(changed) != 0 {
+		klog.V(4).Infof("starting to update deployment [%s] in namespace [%s], changed: %v", temp.Name, temp.Namespace, changed)
+		temp, err = c.kubeClientset.AppsV1().Deployments(temp.Namespace).Update(context.TODO(), updated, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to update deployment [%s] in namespace [%s], error: [%v]", updated.Name, updated.Namespace, err)
+		}
+		return temp, true, nil
+	}
+	// 临时的 pod 可用，并且 service 已经选中它们之后，才能删除旧的 deployment。
+	// service 更新后，UpdateService 会将 app 重新加入队列
+	if !rolloutComplete(temp) || !c.serviceSelects(app, desired.Spec.Template.Labels) {
+		return temp, false, nil
+	}
+	return temp, true, c.recreateDeployment(app, old)
+}
+
+// serviceSelects app 没有 service，或者 service 的 selector 能选中 labels
+func (c *Controller) serviceSelects(app *appcontrollerv1.App, podLabels map[string]string) bool {
+	if app.Spec.ServiceSpec.Name == "" {
+		return true
+	}
+	service, err := c.servicesLister.Services(app.Namespace).Get(app.Spec.ServiceSpec.Name)
+	if err != nil {
+		return errors.IsNotFound(err)
+	}
+	return len(service.Spec.Selector) != 0 && labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(podLabels))
+}
+
+// recreateDeployment 删除 selector 与 app 不一致的 deployment，删除后由 DeleteDeployment 将 app 重新加入队列，下次调谐时按新的 selector 重建。
+// 以 UID 作为删除的前提条件，避免删除已经被重建的 deployment；pod 随 deployment 在后台删除
+func (c *Controller) recreateDeployment(app *appcontrollerv1.App, deploy *appsv1.Deployment) error {
+	klog.V(4).Infof("starting to recreate deployment [%s] in namespace [%s] with new selector", deploy.Name, deploy.Namespace)
+	propagation := metav1.DeletePropagationBackground
+	err := c.kubeClientset.AppsV1().Deployments(deploy.Namespace).Delete(context.TODO(), deploy.Name, metav1.DeleteOptions{
+		Preconditions:     metav1.NewUIDPreconditions(string(deploy.UID)),
+		PropagationPolicy: &propagation,
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete deployment [%s] in namespace [%s] for recreation, error: [%v]", deploy.Name, deploy.Namespace, err)
+	}
+	c.recorder.Eventf(app, corev1.EventTypeNormal, utils.DeploymentRecreated, utils.MessageDeploymentRecreated, deploy.Name)
+	return nil
+}
+
+// finishMigration deployment 按新的 selector 重建并可用后，删除迁移时创建的临时 deployment。返回是否删除了临时的 deployment
+func (c *Controller) finishMigration(app *appcontrollerv1.App, deploy *appsv1.Deployment) (bool, error) {
+	temp, err := c.deploymentsLister.Deployments(deploy.Namespace).Get(migrationName(deploy.Name))
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get deployment [%s] in namespace [%s], error: [%v]", migrationName(deploy.Name), deploy.Namespace, err)
+	}
+	// 同名的 deployment 不是这个 app 创建的，不能删除
+	if !metav1.IsControlledBy(temp, app) || !rolloutComplete(deploy) {
+		return false, nil
+	}
+	klog.V(4).Infof("starting to delete deployment [%s] in namespace [%s] after migration", temp.Name, temp.Namespace)
+	err = c.kubeClientset.AppsV1().Deployments(temp.Namespace).Delete(context.TODO(), temp.Name, metav1.DeleteOptions{
+		Preconditions: metav1.NewUIDPreconditions(string(temp.UID)),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to delete deployment [%s] in namespace [%s] after migration, error: [%v]", temp.Name, temp.Namespace, err)
+	}
+	c.recorder.Eventf(app, corev1.EventTypeNormal, utils.DeploymentMigrated, utils.MessageDeploymentMigrated, deploy.Name, temp.Name)
+	return true, nil
+}
+
+// recreateService 删除 clusterIP 与 app 不一致的 service，以 UID 作为删除的前提条件
+func (c *Controller) recreateService(app *appcontrollerv1.App, service *corev1.Service) error {
+	klog.V(4).Infof("starting to recreate service [%s] in namespace [%s] with new clusterIP", service.Name, service.Namespace)
+	err := c.kubeClientset.CoreV1().Services(service.Namespace).Delete(context.TODO(), service.Name, metav1.DeleteOptions{
+		Preconditions: metav1.NewUIDPreconditions(string(service.UID)),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete service [%s] in namespace [%s] for recreation, error: [%v]", service.Name, service.Namespace, err)
+	}
+	c.recorder.Eventf(app, corev1.EventTypeNormal, utils.ServiceRecreated, utils.MessageServiceRecreated, service.Name)
+	return nil
+}
+
 func (c *Controller) handleError(key string, err error) {
 	// 如果当前key的处理次数，还不到最大重试次数，则再次加入队列
 	if c.workqueue.NumRequeues(key) < utils.MaxRetry {
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	typedappsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+	appslisterv1 "k8s.io/client-go/listers/apps/v1"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"testing"
+)
+
+func TestPodTemplate(t *testing.T) {
+	app := newApp("test")
+
+	// 没有设置 pod 模板时，创建一个使用 app 中 image 的容器
+	pod := podTemplate(app.Spec.DeploymentSpec, app)
+	if len(pod.Spec.Containers) != 1 || pod.Spec.Containers[0].Name != defaultContainerName || pod.Spec.Containers[0].Image != "nginx" {
+		t.Errorf("Expected a single %s container running nginx, got %+v", defaultContainerName, pod.Spec.Containers)
+	}
+	for k, v := range appLabels(app) {
+		if pod.Labels[k] != v {
+			t.Errorf("Expected pod labels %v to contain %s=%s", pod.Labels, k, v)
+		}
+	}
+
+	app.Spec.DeploymentSpec.Template = &corev1.PodTemplateSpec{}
+	app.Spec.DeploymentSpec.Template.Labels = map[string]string{"tier": "frontend", labelName: "overridden"}
+	app.Spec.DeploymentSpec.Template.Spec.Containers = []corev1.Container{
+		{Name: "web"},
+		{Name: "proxy", Image: "envoy"},
+	}
+	pod = podTemplate(app.Spec.DeploymentSpec, app)
+	if pod.Labels["tier"] != "frontend" || pod.Labels[labelName] != "test" {
+		t.Errorf("Expected pod labels to keep tier and override %s, got %v", labelName, pod.Labels)
+	}
+	if len(pod.Spec.Containers) != 2 || pod.Spec.Containers[0].Image != "nginx" || pod.Spec.Containers[1].Image != "envoy" {
+		t.Errorf("Expected the container without an image to run nginx, got %+v", pod.Spec.Containers)
+	}
+	// 不能修改 app 中的模板
+	if app.Spec.DeploymentSpec.Template.Labels[labelName] != "overridden" || app.Spec.DeploymentSpec.Template.Spec.Containers[0].Image != "" {
+		t.Errorf("Expected the App's template not to be modified, got %+v", app.Spec.DeploymentSpec.Template)
+	}
+}
+
+func TestTemplateHash(t *testing.T) {
+	app := newApp("test")
+	deploy := newDeployment(app.Spec.DeploymentSpec, app)
+	if hash := newDeployment(app.Spec.DeploymentSpec, app).Annotations[annoTemplateHash]; hash != deploy.Annotations[annoTemplateHash] {
+		t.Errorf("Expected the same template to have the same hash, got %s and %s", deploy.Annotations[annoTemplateHash], hash)
+	}
+
+	// 修改 app 中的 pod 模板后 hash 不同，replicas 不影响 hash
+	app.Spec.DeploymentSpec.Replicas = 3
+	if hash := newDeployment(app.Spec.DeploymentSpec, app).Annotations[annoTemplateHash]; hash != deploy.Annotations[annoTemplateHash] {
+		t.Errorf("Expected replicas not to change the hash, got %s and %s", deploy.Annotations[annoTemplateHash], hash)
+	}
+	app.Spec.DeploymentSpec.Template = &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Env: []corev1.EnvVar{{Name: "DEBUG", Value: "1"}}}}},
+	}
+	if hash := newDeployment(app.Spec.DeploymentSpec, app).Annotations[annoTemplateHash]; hash == deploy.Annotations[annoTemplateHash] {
+		t.Errorf("Expected a changed template to change the hash, both got %s", hash)
+	}
+}
+
+// fakeDeployments 只实现调谐 deployment 用到的方法，写入直接修改 lister 使用的 indexer，模拟 informer 同步了缓存
+type fakeDeployments struct {
+	typedappsv1.DeploymentInterface
+	indexer cache.Indexer
+	// actions 按顺序记录的写操作，比如 "create test-migration"
+	actions []string
+	// created 创建过的 deployment 的数量，用于生成 UID
+	created int
+}
+
+func (f *fakeDeployments) Create(_ context.Context, deploy *appsv1.Deployment, _ metav1.CreateOptions) (*appsv1.Deployment, error) {
+	deploy = deploy.DeepCopy()
+	deploy.Namespace = metav1.NamespaceDefault
+	f.created++
+	deploy.UID = types.UID(fmt.Sprintf("%s-%d", deploy.Name, f.created))
+	f.actions = append(f.actions, "create "+deploy.Name)
+	return deploy, f.indexer.Add(deploy)
+}
+
+func (f *fakeDeployments) Update(_ context.Context, deploy *appsv1.Deployment, _ metav1.UpdateOptions) (*appsv1.Deployment, error) {
+	f.actions = append(f.actions, "update "+deploy.Name)
+	return deploy, f.indexer.Update(deploy)
+}
+
+func (f *fakeDeployments) Delete(_ context.Context, name string, opts metav1.DeleteOptions) error {
+	obj, exists, err := f.indexer.GetByKey(metav1.NamespaceDefault + "/" + name)
+	if err != nil || !exists {
+		return errors.NewNotFound(appsv1.Resource("deployments"), name)
+	}
+	if opts.Preconditions != nil && *opts.Preconditions.UID != obj.(*appsv1.Deployment).UID {
+		return errors.NewConflict(appsv1.Resource("deployments"), name, nil)
+	}
+	f.actions = append(f.actions, "delete "+name)
+	return f.indexer.Delete(obj)
+}
+
+type fakeAppsV1 struct {
+	typedappsv1.AppsV1Interface
+	deployments *fakeDeployments
+}
+
+func (f fakeAppsV1) Deployments(string) typedappsv1.DeploymentInterface {
+	return f.deployments
+}
+
+type fakeKubeClient struct {
+	kubernetes.Interface
+	deployments *fakeDeployments
+}
+
+func (f fakeKubeClient) AppsV1() typedappsv1.AppsV1Interface {
+	return fakeAppsV1{deployments: f.deployments}
+}
+
+// makeAvailable 模拟 deployment controller 完成滚动更新
+func makeAvailable(t *testing.T, deployments *fakeDeployments, name string) {
+	obj, exists, err := deployments.indexer.GetByKey(metav1.NamespaceDefault + "/" + name)
+	if err != nil || !exists {
+		t.Fatalf("Expected deployment %s to exist", name)
+	}
+	deploy := obj.(*appsv1.Deployment).DeepCopy()
+	replicas := deploymentReplicas(deploy)
+	deploy.Status = appsv1.DeploymentStatus{ObservedGeneration: deploy.Generation, Replicas: replicas, UpdatedReplicas: replicas, AvailableReplicas: replicas}
+	deployments.indexer.Update(deploy)
+}
+
+func TestMigrateDeployment(t *testing.T) {
+	app := newApp("test")
+	app.Namespace = metav1.NamespaceDefault
+	app.Spec.ServiceSpec.Name = ""
+	// 旧版本控制器使用 app-key: app-value 作为 selector 创建的 deployment
+	old := newDeployment(app.Spec.DeploymentSpec, app)
+	old.Namespace = metav1.NamespaceDefault
+	old.UID = "old-uid"
+	old.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app-key": "app-value"}}
+	old.Spec.Template.Labels["app-key"] = "app-value"
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(old)
+	deployments := &fakeDeployments{indexer: indexer}
+	c := &Controller{
+		kubeClientset:     fakeKubeClient{deployments: deployments},
+		deploymentsLister: appslisterv1.NewDeploymentLister(indexer),
+		servicesLister:    corelisterv1.NewServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		recorder:          record.NewFakeRecorder(20),
+	}
+	sync := func(expected ...string) *appsv1.Deployment {
+		t.Helper()
+		deployments.actions = nil
+		deploy, _, err := c.syncDeployment(app)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(deployments.actions, expected) {
+			t.Fatalf("Expected actions %v, got %v", expected, deployments.actions)
+		}
+		return deploy
+	}
+
+	// 1. 创建临时的 deployment，旧的 deployment 继续提供服务
+	temp := sync("create test-migration")
+	if temp.Spec.Selector.MatchLabels[labelMigration] != "true" || temp.Spec.Template.Labels[labelMigration] != "true" {
+		t.Errorf("Expected the temporary deployment to select pods by %s, got selector %v", labelMigration, temp.Spec.Selector.MatchLabels)
+	}
+	sync()
+
+	// 2. 临时的 deployment 可用后，删除旧的 deployment
+	makeAvailable(t, deployments, "test-migration")
+	sync("delete test")
+
+	// 3. 按新的 selector 重建 deployment，可用之前保留临时的 deployment
+	recreated := sync("create test")
+	if !reflect.DeepEqual(recreated.Spec.Selector.MatchLabels, selectorLabels(app)) {
+		t.Errorf("Expected the recreated deployment to use the app selector, got %v", recreated.Spec.Selector.MatchLabels)
+	}
+	// 临时的 deployment 不会选中重建的 deployment 的 pod
+	if selector, _ := metav1.LabelSelectorAsSelector(temp.Spec.Selector); selector.Matches(labels.Set(recreated.Spec.Template.Labels)) {
+		t.Errorf("Expected the temporary deployment not to select pods of the recreated deployment")
+	}
+	sync()
+
+	// 4. 重建的 deployment 可用后，删除临时的 deployment
+	makeAvailable(t, deployments, "test")
+	sync("delete test-migration")
+	sync()
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	appcontrollerv1 "crd-controller-demo/pkg/apis/appcontroller/v1"
+	"crd-controller-demo/pkg/utils"
+)
+
+// 推荐使用的 label，见 https://kubernetes.io/docs/concepts/overview/working-with-objects/common-labels/
+const (
+	// labelName 应用的名称，设置为 app 的名称
+	labelName = "app.kubernetes.io/name"
+	// labelInstance 应用实例的唯一标识，设置为 app 的 UID，app 删除后重建同名的 app，也不会选中之前的 pod
+	labelInstance = "app.kubernetes.io/instance"
+	// labelManagedBy 管理这个资源的工具
+	labelManagedBy = "app.kubernetes.io/managed-by"
+)
+
+// labelMigration 迁移 selector 时，临时 deployment 的 selector 和 pod 上多出的 label，
+// 临时 deployment 只选中自己的 pod，不会选中重建的 deployment 的 pod
+const labelMigration = "appcontroller.k8s.io/migration"
+
+// annoTemplateHash deployment 上记录的 pod 模板的 hash
+const annoTemplateHash = "appcontroller.k8s.io/template-hash"
+
+// selectorLabels 返回 app 的 deployment、service 使用的 selector，pod 的 labels 包含这些label。
+// 每个 app 的 selector 都不同，一个 app 的 service 不会选中其它 app 的 pod
+func selectorLabels(app *appcontrollerv1.App) map[string]string {
+	return map[string]string{
+		labelName:     app.Name,
+		labelInstance: string(app.UID),
+	}
+}
+
+// appLabels 返回 app 创建的 deployment、service 和 pod 上的 labels
+func appLabels(app *appcontrollerv1.App) map[string]string {
+	labels := selectorLabels(app)
+	labels[labelManagedBy] = utils.ControllerAgentName
+	return labels
+}
+
+// mergeMap 将 desired 中的 labels 或 annotations 合并到 live 的副本中，其它工具添加的 key 保持不变。
+// 没有需要修改的 key 时返回 false
+func mergeMap(live, desired map[string]string) (map[string]string, bool) {
+	changed := false
+	merged := make(map[string]string, len(live)+len(desired))
+	for k, v := range live {
+		merged[k] = v
+	}
+	for k, v := range desired {
+		if old, ok := live[k]; !ok || old != v {
+			merged[k] = v
+			changed = true
+		}
+	}
+	return merged, changed
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"crd-controller-demo/pkg/utils"
+	"reflect"
+	"testing"
+)
+
+func TestAppLabels(t *testing.T) {
+	app := newApp("test")
+	selector := selectorLabels(app)
+	expected := map[string]string{labelName: "test", labelInstance: "test-uid"}
+	if !reflect.DeepEqual(selector, expected) {
+		t.Errorf("Expected selector %v, got %v", expected, selector)
+	}
+
+	labels := appLabels(app)
+	for k, v := range selector {
+		if labels[k] != v {
+			t.Errorf("Expected app labels %v to contain the selector %v", labels, selector)
+		}
+	}
+	if labels[labelManagedBy] != utils.ControllerAgentName {
+		t.Errorf("Expected label %s=%s, got %v", labelManagedBy, utils.ControllerAgentName, labels)
+	}
+	// appLabels 返回的 map 不能修改 selector
+	if _, ok := selectorLabels(app)[labelManagedBy]; ok {
+		t.Errorf("Expected selector not to contain %s", labelManagedBy)
+	}
+}
+
+func TestMergeMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		live     map[string]string
+		desired  map[string]string
+		expected map[string]string
+		changed  bool
+	}{
+		{
+			name:     "nil live",
+			desired:  map[string]string{"a": "1"},
+			expected: map[string]string{"a": "1"},
+			changed:  true,
+		},
+		{
+			name:     "keys added by other tools are kept",
+			live:     map[string]string{"a": "1", "team": "payments"},
+			desired:  map[string]string{"a": "1"},
+			expected: map[string]string{"a": "1", "team": "payments"},
+			changed:  false,
+		},
+		{
+			name:     "changed value",
+			live:     map[string]string{"a": "0", "team": "payments"},
+			desired:  map[string]string{"a": "1"},
+			expected: map[string]string{"a": "1", "team": "payments"},
+			changed:  true,
+		},
+		{
+			name:     "empty value",
+			live:     map[string]string{},
+			desired:  map[string]string{"a": ""},
+			expected: map[string]string{"a": ""},
+			changed:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var live map[string]string
+			if test.live != nil {
+				live = map[string]string{}
+				for k, v := range test.live {
+					live[k] = v
+				}
+			}
+			merged, changed := mergeMap(live, test.desired)
+			if changed != test.changed {
+				t.Errorf("Expected changed %v, got %v", test.changed, changed)
+			}
+			if !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, merged)
+			}
+			if !reflect.DeepEqual(live, test.live) && !(live == nil && test.live == nil) {
+				t.Errorf("Expected live map not to be modified, got %v", live)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package controller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"reflect"
+)
+
+// deploymentChanges 比较集群中的 deployment 和 newDeployment 生成的期望的 deployment，
+// 返回只修改了不一致字段的 deployment 副本，以及修改了哪些字段。没有不一致时，返回的字段列表为空。
+// 只把 app 中能设置的字段合并到集群中的 deployment 中，apiserver 填充的默认值、其它工具添加的字段
+// （比如注入的 sidecar 容器、kubectl rollout restart 添加的 annotation）都保持不变。
+// selector 不能修改，由调用方在比较之前处理
+func deploymentChanges(live, desired *appsv1.Deployment) (*appsv1.Deployment, []string) {
+	// 不能直接修改 informer 缓存中的对象
+	updated := live.DeepCopy()
+	var changed []string
+
+	if labels, ok := mergeMap(live.Labels, desired.Labels); ok {
+		updated.Labels = labels
+		changed = append(changed, "labels")
+	}
+	if desired.Spec.Replicas != nil && (live.Spec.Replicas == nil || *live.Spec.Replicas != *desired.Spec.Replicas) {
+		replicas := *desired.Spec.Replicas
+		updated.Spec.Replicas = &replicas
+		changed = append(changed, "replicas")
+	}
+
+	// app 中的模板修改过时（包括删除了字段），模板 hash 不一致，app 的容器整体替换成期望的容器
+	templateChanged := live.Annotations[annoTemplateHash] != desired.Annotations[annoTemplateHash]
+	containers, containerChanges := mergeContainers(updated.Spec.Template.Spec.Containers, desired.Spec.Template.Spec.Containers, templateChanged)
+	updated.Spec.Template.Spec.Containers = containers
+	changed = append(changed, containerChanges...)
+
+	// pod 模板中容器以外的字段，比如 pod 的 labels、volumes
+	wanted := desired.Spec.Template.DeepCopy()
+	wanted.Spec.Containers = nil
+	var template corev1.PodTemplateSpec
+	if mergeFieldsInto(&updated.Spec.Template, wanted, &template) {
+		updated.Spec.Template = template
+		templateChanged = true
+	}
+	if templateChanged {
+		updated.Annotations, _ = mergeMap(live.Annotations, desired.Annotations)
+		changed = append(changed, "template")
+	}
+	return updated, changed
+}
+
+// mergeContainers 按名称把期望的容器合并到集群中的容器中，返回合并后的容器，以及修改了哪些字段。
+// 只有 image 不一致时为 image，缺少容器或者容器的其它字段不一致时为 containers。
+// replace 为 true 时，app 的容器整体替换成期望的容器。其它容器（比如注入的 sidecar）保持不变
+func mergeContainers(live, desired []corev1.Container, replace bool) ([]corev1.Container, []string) {
+	merged := append([]corev1.Container(nil), live...)
+	imageChanged, containersChanged := false, false
+	for _, want := range desired {
+		i := containerIndex(merged, want.Name)
+		switch {
+		case i < 0:
+			merged = append(merged, *want.DeepCopy())
+			containersChanged = true
+		case replace:
+			merged[i] = *want.DeepCopy()
+		default:
+			if merged[i].Image != want.Image {
+				merged[i].Image = want.Image
+				imageChanged = true
+			}
+			var container corev1.Container
+			if mergeFieldsInto(&merged[i], &want, &container) {
+				merged[i] = container
+				containersChanged = true
+			}
+		}
+	}
+	var changed []string
+	if imageChanged {
+		changed = append(changed, "image")
+	}
+	if containersChanged {
+		changed = append(changed, "containers")
+	}
+	return merged, changed
+}
+
+// containerIndex 返回名称为 name 的容器的下标，不存在时返回 -1
+func containerIndex(containers []corev1.Container, name string) int {
+	for i := range containers {
+		if containers[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectorChanged 集群中的 deployment 的 selector 与期望的不一致。selector 创建后不能修改，只能重建 deployment
+func selectorChanged(live, desired *appsv1.Deployment) bool {
+	return !reflect.DeepEqual(live.Spec.Selector, desired.Spec.Selector)
+}
+
+// mergeFieldsInto live 中不包含 desired 中设置了的字段时，把这些字段合并到 live 中，结果写入 out 并返回 true。
+// live 已经包含这些字段时返回 false，不修改 out
+func mergeFieldsInto(live, desired, out interface{}) bool {
+	liveContent, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return false
+	}
+	desiredContent, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return false
+	}
+	if containsFields(liveContent, desiredContent) {
+		return false
+	}
+	merged := mergeFields(liveContent, desiredContent).(map[string]interface{})
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(merged, out); err != nil {
+		utilruntime.HandleError(err)
+		return false
+	}
+	return true
+}
+
+// containsFields 判断 actual 是否包含 desired 中设置了的所有字段：map 只比较 desired 中的 key；
+// 元素都有 name 的 list（比如容器、volumes、环境变量）按 name 比较 desired 中的元素，
+// 其它 list 的长度必须相同，并逐个比较其中的元素；其它值必须相等
+func containsFields(actual, desired interface{}) bool {
+	switch desired := desired.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		actual, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range desired {
+			if !containsFields(actual[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok {
+			return false
+		}
+		if namedList(desired) {
+			for _, v := range desired {
+				i := namedIndex(actual, v)
+				if i < 0 || !containsFields(actual[i], v) {
+					return false
+				}
+			}
+			return true
+		}
+		if len(actual) != len(desired) {
+			return false
+		}
+		for i := range desired {
+			if !containsFields(actual[i], desired[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(actual, desired)
+	}
+}
+
+// mergeFields 返回把 desired 中设置了的字段合并到 actual 中的结果，不修改 actual：map 按 key 合并；
+// 元素都有 name 的 list 按 name 合并，actual 中的其它元素保持不变；其它 list 和值使用 desired 中的
+func mergeFields(actual, desired interface{}) interface{} {
+	switch desired := desired.(type) {
+	case nil:
+		return actual
+	case map[string]interface{}:
+		actual, _ := actual.(map[string]interface{})
+		merged := make(map[string]interface{}, len(actual)+len(desired))
+		for k, v := range actual {
+			merged[k] = v
+		}
+		for k, v := range desired {
+			merged[k] = mergeFields(actual[k], v)
+		}
+		return merged
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok || !namedList(desired) {
+			return desired
+		}
+		merged := append([]interface{}(nil), actual...)
+		for _, v := range desired {
+			if i := namedIndex(merged, v); i >= 0 {
+				merged[i] = mergeFields(merged[i], v)
+			} else {
+				merged = append(merged, v)
+			}
+		}
+		return merged
+	default:
+		return desired
+	}
+}
+
+// namedList list 不为空，并且所有元素都是有 name 的对象
+func namedList(list []interface{}) bool {
+	for _, v := range list {
+		if _, ok := elementName(v); !ok {
+			return false
+		}
+	}
+	return len(list) != 0
+}
+
+// namedIndex 返回 list 中与 element 的 name 相同的元素的下标，不存在时返回 -1
+func namedIndex(list []interface{}, element interface{}) int {
+	name, _ := elementName(element)
+	for i, v := range list {
+		if n, ok := elementName(v); ok && n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// elementName 返回 list 中的对象的 name
+func elementName(element interface{}) (string, bool) {
+	object, ok := element.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := object["name"].(string)
+	return name, ok
+}
+
+// serviceChanges 比较集群中的 service 和 newService 生成的期望的 service，
+// 返回只修改了不一致字段的 service 副本，以及修改了哪些字段。没有不一致时，返回的字段列表为空
+func serviceChanges(live, desired *corev1.Service) (*corev1.Service, []string) {
+	updated := live.DeepCopy()
+	var changed []string
+
+	if labels, ok := mergeMap(live.Labels, desired.Labels); ok {
+		updated.Labels = labels
+		changed = append(changed, "labels")
+	}
+	if !reflect.DeepEqual(live.Spec.Selector, desired.Spec.Selector) {
+		updated.Spec.Selector = desired.Spec.Selector
+		changed = append(changed, "selector")
+	}
+	if live.Spec.Type != desired.Spec.Type {
+		updated.Spec.Type = desired.Spec.Type
+		changed = append(changed, "type")
+	}
+	if live.Spec.SessionAffinity != desired.Spec.SessionAffinity {
+		updated.Spec.SessionAffinity = desired.Spec.SessionAffinity
+		// sessionAffinityConfig 只能和 ClientIP 一起使用，由 apiserver 重新填充默认值
+		updated.Spec.SessionAffinityConfig = nil
+		changed = append(changed, "sessionAffinity")
+	}
+	if !servicePortsEqual(live.Spec.Ports, desired.Spec.Ports) {
+		updated.Spec.Ports = mergeNodePorts(live.Spec.Ports, desired.Spec.Ports, desired.Spec.Type)
+		changed = append(changed, "ports")
+	}
+	return updated, changed
+}
+
+// servicePortsEqual 比较期望的端口中设置了的字段。期望的端口没有设置 nodePort 时，不比较由 apiserver 分配的 nodePort
+func servicePortsEqual(live, desired []corev1.ServicePort) bool {
+	if len(live) != len(desired) {
+		return false
+	}
+	for i := range desired {
+		if live[i].Name != desired[i].Name || live[i].Port != desired[i].Port || live[i].Protocol != desired[i].Protocol ||
+			live[i].TargetPort != desired[i].TargetPort {
+			return false
+		}
+		if desired[i].NodePort != 0 && live[i].NodePort != desired[i].NodePort {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeNodePorts 返回更新后的端口。service 仍需要 nodePort 时，没有指定 nodePort 的端口沿用之前分配的 nodePort，避免每次修改端口都重新分配
+func mergeNodePorts(live, desired []corev1.ServicePort, serviceType corev1.ServiceType) []corev1.ServicePort {
+	ports := make([]corev1.ServicePort, len(desired))
+	copy(ports, desired)
+	if serviceType != corev1.ServiceTypeNodePort && serviceType != corev1.ServiceTypeLoadBalancer {
+		return ports
+	}
+	for i := range ports {
+		if ports[i].NodePort != 0 {
+			continue
+		}
+		for _, port := range live {
+			if port.Port == ports[i].Port && port.Protocol == ports[i].Protocol {
+				ports[i].NodePort = port.NodePort
+				break
+			}
+		}
+	}
+	return ports
+}
@@ -0,0 +1,412 @@
+package controller
+
+import (
+	appcontrollerv1 "crd-controller-demo/pkg/apis/appcontroller/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"reflect"
+	"testing"
+)
+
+func newApp(name string) *appcontrollerv1.App {
+	return &appcontrollerv1.App{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  metav1.NamespaceDefault,
+			UID:        types.UID(name + "-uid"),
+			Generation: 1,
+		},
+		Spec: appcontrollerv1.AppSpec{
+			DeploymentSpec: appcontrollerv1.DeploymentTemplate{Name: name, Image: "nginx", Replicas: 2},
+			ServiceSpec:    appcontrollerv1.ServiceTemplate{Name: name},
+		},
+	}
+}
+
+// liveDeployment 模拟 apiserver 返回的 deployment：填充了默认值，并带有其它工具添加的 label 和 annotation
+func liveDeployment(desired *appsv1.Deployment) *appsv1.Deployment {
+	live := desired.DeepCopy()
+	metav1.SetMetaDataLabel(&live.ObjectMeta, "team", "payments")
+	metav1.SetMetaDataAnnotation(&live.ObjectMeta, "deployment.kubernetes.io/revision", "3")
+	live.Spec.Template.Annotations = map[string]string{"kubectl.kubernetes.io/restartedAt": "2024-01-01T00:00:00Z"}
+	live.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	live.Spec.Template.Spec.DNSPolicy = corev1.DNSClusterFirst
+	for i := range live.Spec.Template.Spec.Containers {
+		container := &live.Spec.Template.Spec.Containers[i]
+		container.TerminationMessagePath = corev1.TerminationMessagePathDefault
+		container.ImagePullPolicy = corev1.PullAlways
+		for j := range container.Ports {
+			container.Ports[j].Protocol = corev1.ProtocolTCP
+		}
+	}
+	return live
+}
+
+func TestDeploymentChanges(t *testing.T) {
+	app := newApp("test")
+	app.Spec.DeploymentSpec.Template = &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "web",
+			Env:   []corev1.EnvVar{{Name: "NGINX_PORT", Value: "80"}},
+			Ports: []corev1.ContainerPort{{ContainerPort: 80}},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("0.1")},
+			},
+		}}},
+	}
+	desired := newDeployment(app.Spec.DeploymentSpec, app)
+
+	tests := []struct {
+		name    string
+		live    func() *appsv1.Deployment
+		changed []string
+	}{
+		{
+			name:    "defaulted deployment is up to date",
+			live:    func() *appsv1.Deployment { return liveDeployment(desired) },
+			changed: nil,
+		},
+		{
+			name: "replicas scaled by hand",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Replicas = new(int32)
+				return live
+			},
+			changed: []string{"replicas"},
+		},
+		{
+			name: "app label removed",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				delete(live.Labels, labelManagedBy)
+				return live
+			},
+			changed: []string{"labels"},
+		},
+		{
+			name: "image set by kubectl set image",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Containers[0].Image = "nginx:1.25"
+				return live
+			},
+			changed: []string{"image"},
+		},
+		{
+			name: "container renamed by hand",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Containers[0].Name = "renamed"
+				return live
+			},
+			changed: []string{"containers"},
+		},
+		{
+			name: "env changed by hand",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Containers[0].Env[0].Value = "8080"
+				return live
+			},
+			changed: []string{"containers"},
+		},
+		{
+			name: "env added by hand",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Containers[0].Env = append(live.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "DEBUG", Value: "1"})
+				return live
+			},
+			changed: nil,
+		},
+		{
+			name: "sidecar injected",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Containers = append(live.Spec.Template.Spec.Containers, corev1.Container{Name: "proxy", Image: "envoy"})
+				return live
+			},
+			changed: nil,
+		},
+		{
+			name: "sidecar injected and image set by hand",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Containers = append([]corev1.Container{{Name: "proxy", Image: "envoy"}}, live.Spec.Template.Spec.Containers...)
+				live.Spec.Template.Spec.Containers[1].Image = "nginx:1.25"
+				return live
+			},
+			changed: []string{"image"},
+		},
+		{
+			name: "volume injected",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Volumes = append(live.Spec.Template.Spec.Volumes, corev1.Volume{Name: "istio-envoy"})
+				return live
+			},
+			changed: nil,
+		},
+		{
+			name: "resources changed by hand",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Spec.Template.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("1")
+				return live
+			},
+			changed: []string{"containers"},
+		},
+		{
+			name: "template changed in the app",
+			live: func() *appsv1.Deployment {
+				live := liveDeployment(desired)
+				live.Annotations[annoTemplateHash] = "outdated"
+				return live
+			},
+			changed: []string{"template"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			live := test.live()
+			updated, changed := deploymentChanges(live, desired)
+			if !reflect.DeepEqual(changed, test.changed) {
+				t.Fatalf("Expected changed fields %v, got %v", test.changed, changed)
+			}
+			if updated.Labels["team"] != "payments" {
+				t.Errorf("Expected label added by another tool to be kept, got %v", updated.Labels)
+			}
+			// 只合并 app 设置的字段，其它工具添加的容器和 annotation 保持不变
+			for _, container := range live.Spec.Template.Spec.Containers {
+				if containerIndex(updated.Spec.Template.Spec.Containers, container.Name) < 0 {
+					t.Errorf("Expected container %s added by another tool to be kept, got %+v", container.Name, updated.Spec.Template.Spec.Containers)
+				}
+			}
+			if len(updated.Spec.Template.Spec.Volumes) != len(live.Spec.Template.Spec.Volumes) {
+				t.Errorf("Expected volumes added by another tool to be kept, got %+v", updated.Spec.Template.Spec.Volumes)
+			}
+			if updated.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] == "" {
+				t.Errorf("Expected annotation added by kubectl rollout restart to be kept, got %v", updated.Spec.Template.Annotations)
+			}
+			if _, changed := deploymentChanges(updated, desired); len(changed) != 0 {
+				t.Errorf("Expected updated deployment to be up to date, still changed: %v", changed)
+			}
+		})
+	}
+}
+
+func TestSelectorChanged(t *testing.T) {
+	app := newApp("test")
+	desired := newDeployment(app.Spec.DeploymentSpec, app)
+
+	// 旧版本控制器创建的 deployment 使用 app-key: app-value 作为 selector
+	old := desired.DeepCopy()
+	old.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app-key": "app-value"}}
+	if !selectorChanged(old, desired) {
+		t.Errorf("Expected deployment with the old selector to need a migration")
+	}
+	if selectorChanged(liveDeployment(desired), desired) {
+		t.Errorf("Expected deployment with the app selector not to need a migration")
+	}
+
+	// 删除后重建的同名 app 的 UID 不同，selector 也不同
+	recreated := newApp("test")
+	recreated.UID = "recreated-uid"
+	if !selectorChanged(desired, newDeployment(recreated.Spec.DeploymentSpec, recreated)) {
+		t.Errorf("Expected deployment of a deleted app with the same name to need a migration")
+	}
+}
+
+func TestServiceChanges(t *testing.T) {
+	app := newApp("test")
+	app.Spec.ServiceSpec.Type = appcontrollerv1.ServiceTypeNodePort
+	app.Spec.ServiceSpec.Ports = []appcontrollerv1.ServicePort{{Name: "http", Port: 80}}
+	desired := newService(app.Spec.ServiceSpec, app)
+
+	live := desired.DeepCopy()
+	live.Spec.ClusterIP = "10.0.0.10"
+	live.Spec.Ports[0].NodePort = 30080
+	live.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyCluster
+
+	tests := []struct {
+		name    string
+		update  func(live *corev1.Service, desired *corev1.Service)
+		changed []string
+	}{
+		{
+			name:    "allocated nodePort and defaults are ignored",
+			update:  func(live, desired *corev1.Service) {},
+			changed: nil,
+		},
+		{
+			name: "old selector is migrated",
+			update: func(live, desired *corev1.Service) {
+				live.Spec.Selector = map[string]string{"app-key": "app-value"}
+			},
+			changed: []string{"selector"},
+		},
+		{
+			name: "type changed",
+			update: func(live, desired *corev1.Service) {
+				desired.Spec.Type = corev1.ServiceTypeLoadBalancer
+			},
+			changed: []string{"type"},
+		},
+		{
+			name: "session affinity changed",
+			update: func(live, desired *corev1.Service) {
+				desired.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+			},
+			changed: []string{"sessionAffinity"},
+		},
+		{
+			name: "port added",
+			update: func(live, desired *corev1.Service) {
+				desired.Spec.Ports = append(desired.Spec.Ports, corev1.ServicePort{
+					Name: "metrics", Port: 9090, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt32(9090),
+				})
+			},
+			changed: []string{"ports"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			live, desired := live.DeepCopy(), desired.DeepCopy()
+			test.update(live, desired)
+			updated, changed := serviceChanges(live, desired)
+			if !reflect.DeepEqual(changed, test.changed) {
+				t.Fatalf("Expected changed fields %v, got %v", test.changed, changed)
+			}
+			if updated.Spec.ClusterIP != live.Spec.ClusterIP {
+				t.Errorf("Expected clusterIP %q to be kept, got %q", live.Spec.ClusterIP, updated.Spec.ClusterIP)
+			}
+			if updated.Spec.Ports[0].NodePort != 30080 {
+				t.Errorf("Expected allocated nodePort 30080 to be kept, got %d", updated.Spec.Ports[0].NodePort)
+			}
+			if !reflect.DeepEqual(updated.Spec.Selector, desired.Spec.Selector) {
+				t.Errorf("Expected selector %v, got %v", desired.Spec.Selector, updated.Spec.Selector)
+			}
+		})
+	}
+}
+
+func TestServicePortsEqual(t *testing.T) {
+	desired := []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt32(8080)}}
+	tests := []struct {
+		name  string
+		live  func(ports []corev1.ServicePort)
+		equal bool
+	}{
+		{name: "same ports", live: func(ports []corev1.ServicePort) {}, equal: true},
+		{name: "allocated nodePort", live: func(ports []corev1.ServicePort) { ports[0].NodePort = 30080 }, equal: true},
+		{name: "different name", live: func(ports []corev1.ServicePort) { ports[0].Name = "web" }, equal: false},
+		{name: "different port", live: func(ports []corev1.ServicePort) { ports[0].Port = 81 }, equal: false},
+		{name: "different protocol", live: func(ports []corev1.ServicePort) { ports[0].Protocol = corev1.ProtocolUDP }, equal: false},
+		{name: "named targetPort", live: func(ports []corev1.ServicePort) { ports[0].TargetPort = intstr.FromString("http") }, equal: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			live := append([]corev1.ServicePort{}, desired...)
+			test.live(live)
+			if equal := servicePortsEqual(live, desired); equal != test.equal {
+				t.Errorf("Expected servicePortsEqual to return %v, got %v", test.equal, equal)
+			}
+		})
+	}
+
+	if servicePortsEqual(desired, append(desired, desired[0])) {
+		t.Errorf("Expected ports of different length not to be equal")
+	}
+	withNodePort := []corev1.ServicePort{desired[0]}
+	withNodePort[0].NodePort = 30090
+	live := []corev1.ServicePort{desired[0]}
+	live[0].NodePort = 30080
+	if servicePortsEqual(live, withNodePort) {
+		t.Errorf("Expected ports with a different nodePort set in the app not to be equal")
+	}
+}
+
+func TestMergeNodePorts(t *testing.T) {
+	live := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP, NodePort: 30080},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP, NodePort: 30053},
+	}
+	desired := []corev1.ServicePort{
+		{Name: "web", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolTCP},
+		{Name: "metrics", Port: 9090, Protocol: corev1.ProtocolTCP, NodePort: 30090},
+	}
+	tests := []struct {
+		serviceType corev1.ServiceType
+		nodePorts   []int32
+	}{
+		// 端口改名后沿用之前分配的 nodePort，协议不同的端口不沿用
+		{serviceType: corev1.ServiceTypeNodePort, nodePorts: []int32{30080, 0, 30090}},
+		{serviceType: corev1.ServiceTypeLoadBalancer, nodePorts: []int32{30080, 0, 30090}},
+		// 切换成 ClusterIP 后不再需要 nodePort
+		{serviceType: corev1.ServiceTypeClusterIP, nodePorts: []int32{0, 0, 30090}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.serviceType), func(t *testing.T) {
+			ports := mergeNodePorts(live, desired, test.serviceType)
+			var nodePorts []int32
+			for _, port := range ports {
+				nodePorts = append(nodePorts, port.NodePort)
+			}
+			if !reflect.DeepEqual(nodePorts, test.nodePorts) {
+				t.Errorf("Expected nodePorts %v, got %v", test.nodePorts, nodePorts)
+			}
+			if desired[0].NodePort != 0 {
+				t.Errorf("Expected desired ports not to be modified")
+			}
+		})
+	}
+}
+
+func TestServicePorts(t *testing.T) {
+	// 没有设置端口时，默认暴露 8080 端口
+	expected := []corev1.ServicePort{{Name: "app-service", Port: 8080, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt32(8080)}}
+	if ports := servicePorts(nil); !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected ports %v, got %v", expected, ports)
+	}
+
+	ports := servicePorts([]appcontrollerv1.ServicePort{
+		{Name: "http", Port: 80, TargetPort: intstr.FromString("web")},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP, NodePort: 30053},
+	})
+	expected = []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromString("web")},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP, TargetPort: intstr.FromInt32(53), NodePort: 30053},
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected ports %v, got %v", expected, ports)
+	}
+}
+
+func TestNewServiceType(t *testing.T) {
+	app := newApp("test")
+	tests := []struct {
+		serviceType appcontrollerv1.ServiceType
+		expected    corev1.ServiceType
+		headless    bool
+	}{
+		{serviceType: "", expected: corev1.ServiceTypeClusterIP},
+		{serviceType: appcontrollerv1.ServiceTypeNodePort, expected: corev1.ServiceTypeNodePort},
+		{serviceType: appcontrollerv1.ServiceTypeLoadBalancer, expected: corev1.ServiceTypeLoadBalancer},
+		{serviceType: appcontrollerv1.ServiceTypeHeadless, expected: corev1.ServiceTypeClusterIP, headless: true},
+	}
+	for _, test := range tests {
+		t.Run(string(test.serviceType), func(t *testing.T) {
+			app.Spec.ServiceSpec.Type = test.serviceType
+			service := newService(app.Spec.ServiceSpec, app)
+			if service.Spec.Type != test.expected || isHeadless(service) != test.headless {
+				t.Errorf("Expected type %s with headless %v, got %s with clusterIP %q", test.expected, test.headless, service.Spec.Type, service.Spec.ClusterIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	appcontrollerv1 "crd-controller-demo/pkg/apis/appcontroller/v1"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// condition 的 reason
+const (
+	// reasonAvailable deployment 的副本全部可用，service 已经创建
+	reasonAvailable = "Available"
+	// reasonDeploymentPending deployment 还没有创建，或者正在重建
+	reasonDeploymentPending = "DeploymentPending"
+	// reasonRollingOut deployment 正在滚动更新或扩缩容
+	reasonRollingOut = "RollingOut"
+	// reasonRolloutComplete deployment 的滚动更新已经完成
+	reasonRolloutComplete = "RolloutComplete"
+	// reasonServicePending service 还没有创建，或者正在重建
+	reasonServicePending = "ServicePending"
+	// reasonLoadBalancerPending LoadBalancer 类型的 service 还没有分配到地址
+	reasonLoadBalancerPending = "LoadBalancerPending"
+	// reasonSyncFailed 调谐 deployment 或 service 失败，比如同名的资源并非 app 所控制
+	reasonSyncFailed = "SyncFailed"
+	// reasonProgressDeadlineExceeded deployment 超过了 progressDeadlineSeconds 仍未完成滚动更新
+	reasonProgressDeadlineExceeded = "ProgressDeadlineExceeded"
+	// reasonReplicaFailure deployment 无法创建 pod，比如超出了 ResourceQuota
+	reasonReplicaFailure = "ReplicaFailure"
+	// reasonAsExpected 没有异常
+	reasonAsExpected = "AsExpected"
+)
+
+// updateAppStatus 根据 deployment、service 和调谐的错误计算 AppStatus，通过 status 子资源更新。
+// deploy、service 为 nil 表示 app 没有设置，或者还没有创建。status 没有变化时不更新，避免每次调谐都修改 resourceVersion
+func (c *Controller) updateAppStatus(app *appcontrollerv1.App, deploy *appsv1.Deployment, service *corev1.Service, syncErr error) error {
+	status := app.Status.DeepCopy()
+	status.ObservedGeneration = app.Generation
+	// 调谐失败时保留上一次观察到的 deployment、service 的 status
+	if syncErr == nil {
+		status.DeploymentStatus = nil
+		if deploy != nil {
+			status.DeploymentStatus = deploy.Status.DeepCopy()
+		}
+		status.ServiceStatus = nil
+		if service != nil {
+			status.ServiceStatus = service.Status.DeepCopy()
+		}
+	}
+	for _, condition := range appConditions(app, deploy, service, syncErr) {
+		condition.ObservedGeneration = app.Generation
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+
+	if equality.Semantic.DeepEqual(&app.Status, status) {
+		return nil
+	}
+	app.Status = *status
+	_, err := c.appClientset.AppcontrollerV1().Apps(app.Namespace).UpdateStatus(context.TODO(), app, metav1.UpdateOptions{})
+	return err
+}
+
+// appConditions 计算 app 的 Ready、Progressing、Degraded 三个 condition
+func appConditions(app *appcontrollerv1.App, deploy *appsv1.Deployment, service *corev1.Service, syncErr error) []metav1.Condition {
+	degraded := metav1.Condition{Type: appcontrollerv1.AppDegraded, Status: metav1.ConditionFalse, Reason: reasonAsExpected}
+	switch {
+	case syncErr != nil:
+		degraded.Status, degraded.Reason, degraded.Message = metav1.ConditionTrue, reasonSyncFailed, syncErr.Error()
+	case deploy != nil:
+		if condition := deploymentCondition(deploy, appsv1.DeploymentProgressing); condition != nil && condition.Reason == reasonProgressDeadlineExceeded {
+			degraded.Status, degraded.Reason, degraded.Message = metav1.ConditionTrue, reasonProgressDeadlineExceeded, condition.Message
+		} else if condition := deploymentCondition(deploy, appsv1.DeploymentReplicaFailure); condition != nil && condition.Status == corev1.ConditionTrue {
+			degraded.Status, degraded.Reason, degraded.Message = metav1.ConditionTrue, reasonReplicaFailure, condition.Message
+		}
+	}
+
+	progressing := metav1.Condition{Type: appcontrollerv1.AppProgressing, Status: metav1.ConditionFalse, Reason: reasonRolloutComplete}
+	switch {
+	case syncErr != nil:
+		// 调谐失败时不知道 deployment 的状态，保留上一次的结果
+		if last := meta.FindStatusCondition(app.Status.Conditions, appcontrollerv1.AppProgressing); last != nil {
+			progressing = *last
+		}
+	case deploy == nil && app.Spec.DeploymentSpec.Name != "":
+		progressing.Status, progressing.Reason = metav1.ConditionTrue, reasonDeploymentPending
+		progressing.Message = fmt.Sprintf("Deployment %q is being created", app.Spec.DeploymentSpec.Name)
+	case deploy != nil && !rolloutComplete(deploy):
+		progressing.Status, progressing.Reason = metav1.ConditionTrue, reasonRollingOut
+		progressing.Message = fmt.Sprintf("Deployment %q has %d of %d replicas updated and %d available",
+			deploy.Name, deploy.Status.UpdatedReplicas, deploymentReplicas(deploy), deploy.Status.AvailableReplicas)
+	}
+
+	ready := metav1.Condition{Type: appcontrollerv1.AppReady, Status: metav1.ConditionTrue, Reason: reasonAvailable}
+	switch {
+	case degraded.Status == metav1.ConditionTrue:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, degraded.Reason, degraded.Message
+	case progressing.Status == metav1.ConditionTrue:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, progressing.Reason, progressing.Message
+	case service == nil && app.Spec.ServiceSpec.Name != "":
+		ready.Status, ready.Reason = metav1.ConditionFalse, reasonServicePending
+		ready.Message = fmt.Sprintf("Service %q is being created", app.Spec.ServiceSpec.Name)
+	case service != nil && service.Spec.Type == corev1.ServiceTypeLoadBalancer && len(service.Status.LoadBalancer.Ingress) == 0:
+		ready.Status, ready.Reason = metav1.ConditionFalse, reasonLoadBalancerPending
+		ready.Message = fmt.Sprintf("Service %q is waiting for a load balancer", service.Name)
+	}
+
+	return []metav1.Condition{ready, progressing, degraded}
+}
+
+// rolloutComplete deployment controller 已经处理了最新的 spec，并且所有副本都已更新、可用，没有旧的副本
+func rolloutComplete(deploy *appsv1.Deployment) bool {
+	replicas := deploymentReplicas(deploy)
+	return deploy.Status.ObservedGeneration >= deploy.Generation &&
+		deploy.Status.UpdatedReplicas == replicas &&
+		deploy.Status.Replicas == replicas &&
+		deploy.Status.AvailableReplicas == replicas
+}
+
+// deploymentReplicas 返回 deployment 期望的副本数，没有设置时默认为 1
+func deploymentReplicas(deploy *appsv1.Deployment) int32 {
+	if deploy.Spec.Replicas == nil {
+		return 1
+	}
+	return *deploy.Spec.Replicas
+}
+
+// deploymentCondition 返回 deployment 中指定类型的 condition，不存在时返回 nil
+func deploymentCondition(deploy *appsv1.Deployment, conditionType appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	for i := range deploy.Status.Conditions {
+		if deploy.Status.Conditions[i].Type == conditionType {
+			return &deploy.Status.Conditions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	appcontrollerv1 "crd-controller-demo/pkg/apis/appcontroller/v1"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+// availableDeployment 返回所有副本都已更新、可用的 deployment
+func availableDeployment(app *appcontrollerv1.App) *appsv1.Deployment {
+	deploy := newDeployment(app.Spec.DeploymentSpec, app)
+	deploy.Generation = 2
+	deploy.Status = appsv1.DeploymentStatus{
+		ObservedGeneration: 2,
+		Replicas:           *deploy.Spec.Replicas,
+		UpdatedReplicas:    *deploy.Spec.Replicas,
+		AvailableReplicas:  *deploy.Spec.Replicas,
+	}
+	return deploy
+}
+
+func TestAppConditions(t *testing.T) {
+	app := newApp("test")
+	service := newService(app.Spec.ServiceSpec, app)
+
+	tests := []struct {
+		name        string
+		deploy      func() *appsv1.Deployment
+		service     *corev1.Service
+		syncErr     error
+		ready       metav1.ConditionStatus
+		reason      string
+		progressing metav1.ConditionStatus
+		degraded    metav1.ConditionStatus
+	}{
+		{
+			name:        "available",
+			deploy:      func() *appsv1.Deployment { return availableDeployment(app) },
+			service:     service,
+			ready:       metav1.ConditionTrue,
+			reason:      reasonAvailable,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionFalse,
+		},
+		{
+			name:        "deployment being created",
+			deploy:      func() *appsv1.Deployment { return nil },
+			service:     service,
+			ready:       metav1.ConditionFalse,
+			reason:      reasonDeploymentPending,
+			progressing: metav1.ConditionTrue,
+			degraded:    metav1.ConditionFalse,
+		},
+		{
+			name: "rolling out",
+			deploy: func() *appsv1.Deployment {
+				deploy := availableDeployment(app)
+				deploy.Status.UpdatedReplicas = 1
+				return deploy
+			},
+			service:     service,
+			ready:       metav1.ConditionFalse,
+			reason:      reasonRollingOut,
+			progressing: metav1.ConditionTrue,
+			degraded:    metav1.ConditionFalse,
+		},
+		{
+			name: "spec not observed yet",
+			deploy: func() *appsv1.Deployment {
+				deploy := availableDeployment(app)
+				deploy.Generation = 3
+				return deploy
+			},
+			service:     service,
+			ready:       metav1.ConditionFalse,
+			reason:      reasonRollingOut,
+			progressing: metav1.ConditionTrue,
+			degraded:    metav1.ConditionFalse,
+		},
+		{
+			name: "progress deadline exceeded",
+			deploy: func() *appsv1.Deployment {
+				deploy := availableDeployment(app)
+				deploy.Status.UpdatedReplicas = 1
+				deploy.Status.Conditions = []appsv1.DeploymentCondition{{
+					Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: reasonProgressDeadlineExceeded,
+				}}
+				return deploy
+			},
+			service:     service,
+			ready:       metav1.ConditionFalse,
+			reason:      reasonProgressDeadlineExceeded,
+			progressing: metav1.ConditionTrue,
+			degraded:    metav1.ConditionTrue,
+		},
+		{
+			name: "replica failure",
+			deploy: func() *appsv1.Deployment {
+				deploy := availableDeployment(app)
+				deploy.Status.Conditions = []appsv1.DeploymentCondition{{
+					Type: appsv1.DeploymentReplicaFailure, Status: corev1.ConditionTrue, Message: "exceeded quota",
+				}}
+				return deploy
+			},
+			service:     service,
+			ready:       metav1.ConditionFalse,
+			reason:      reasonReplicaFailure,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionTrue,
+		},
+		{
+			name:        "service being created",
+			deploy:      func() *appsv1.Deployment { return availableDeployment(app) },
+			ready:       metav1.ConditionFalse,
+			reason:      reasonServicePending,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionFalse,
+		},
+		{
+			name:   "load balancer pending",
+			deploy: func() *appsv1.Deployment { return availableDeployment(app) },
+			service: func() *corev1.Service {
+				service := service.DeepCopy()
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+				return service
+			}(),
+			ready:       metav1.ConditionFalse,
+			reason:      reasonLoadBalancerPending,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionFalse,
+		},
+		{
+			name:        "sync failed",
+			deploy:      func() *appsv1.Deployment { return nil },
+			syncErr:     fmt.Errorf("resource \"test\" already exists and is not managed by App"),
+			ready:       metav1.ConditionFalse,
+			reason:      reasonSyncFailed,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionTrue,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conditions := appConditions(app, test.deploy(), test.service, test.syncErr)
+			if len(conditions) != 3 {
+				t.Fatalf("Expected 3 conditions, got %d", len(conditions))
+			}
+			ready, progressing, degraded := conditions[0], conditions[1], conditions[2]
+			if ready.Type != appcontrollerv1.AppReady || progressing.Type != appcontrollerv1.AppProgressing || degraded.Type != appcontrollerv1.AppDegraded {
+				t.Fatalf("Expected Ready, Progressing and Degraded conditions, got %s, %s and %s", ready.Type, progressing.Type, degraded.Type)
+			}
+			if ready.Status != test.ready || ready.Reason != test.reason {
+				t.Errorf("Expected Ready %s with reason %s, got %s with reason %s", test.ready, test.reason, ready.Status, ready.Reason)
+			}
+			if progressing.Status != test.progressing {
+				t.Errorf("Expected Progressing %s, got %s", test.progressing, progressing.Status)
+			}
+			if degraded.Status != test.degraded {
+				t.Errorf("Expected Degraded %s, got %s", test.degraded, degraded.Status)
+			}
+		})
+	}
+}
+
+func TestAppConditionsKeepProgressingOnSyncError(t *testing.T) {
+	app := newApp("test")
+	app.Status.Conditions = []metav1.Condition{{
+		Type: appcontrollerv1.AppProgressing, Status: metav1.ConditionTrue, Reason: reasonRollingOut,
+	}}
+	conditions := appConditions(app, nil, nil, fmt.Errorf("failed"))
+	if progressing := conditions[1]; progressing.Status != metav1.ConditionTrue || progressing.Reason != reasonRollingOut {
+		t.Errorf("Expected Progressing to be kept on a sync error, got %s with reason %s", progressing.Status, progressing.Reason)
+	}
+}
+
+func TestRolloutComplete(t *testing.T) {
+	app := newApp("test")
+	if !rolloutComplete(availableDeployment(app)) {
+		t.Errorf("Expected rollout of an available deployment to be complete")
+	}
+
+	// 滚动更新过程中，旧的副本还没有删除
+	surge := availableDeployment(app)
+	surge.Status.Replicas++
+	if rolloutComplete(surge) {
+		t.Errorf("Expected rollout with old replicas left not to be complete")
+	}
+
+	// 没有设置 replicas 时默认为 1
+	single := availableDeployment(app)
+	single.Spec.Replicas = nil
+	single.Status.Replicas, single.Status.UpdatedReplicas, single.Status.AvailableReplicas = 1, 1, 1
+	if !rolloutComplete(single) {
+		t.Errorf("Expected rollout of a deployment without replicas to be complete with 1 replica")
+	}
+}
@@ -18,3 +18,51 @@ const (
 	// is synced successfully
 	MessageResourceSynced = "App synced successfully"
 )
+
+const (
+	// DeploymentUpdated is used as part of the Event 'reason' when the spec of a
+	// Deployment is rolled out to match its App
+	DeploymentUpdated = "DeploymentUpdated"
+	// ServiceUpdated is used as part of the Event 'reason' when the spec of a
+	// Service is rolled out to match its App
+	ServiceUpdated = "ServiceUpdated"
+
+	// MessageDeploymentUpdated is the message used for Events when a Deployment
+	// is updated, followed by the fields that changed
+	MessageDeploymentUpdated = "Deployment %q updated: %s"
+	// MessageServiceUpdated is the message used for Events when a Service
+	// is updated, followed by the fields that changed
+	MessageServiceUpdated = "Service %q updated: %s"
+)
+
+const (
+	// DeploymentMigrating is used as part of the Event 'reason' when a temporary
+	// Deployment is created to serve traffic while a Deployment is re-created
+	DeploymentMigrating = "DeploymentMigrating"
+	// DeploymentRecreated is used as part of the Event 'reason' when a Deployment
+	// is deleted to be re-created with the label selector of its App
+	DeploymentRecreated = "DeploymentRecreated"
+	// DeploymentMigrated is used as part of the Event 'reason' when the temporary
+	// Deployment is deleted after the re-created Deployment became available
+	DeploymentMigrated = "DeploymentMigrated"
+
+	// MessageDeploymentMigrating is the message used for Events when a Deployment
+	// has an outdated selector and a temporary Deployment is created in its place
+	MessageDeploymentMigrating = "Deployment %q has an outdated selector, created %q to serve the App until it is re-created"
+	// MessageDeploymentRecreated is the message used for Events when a Deployment
+	// is deleted because its immutable selector does not match its App
+	MessageDeploymentRecreated = "Deployment %q has an outdated selector, deleted it to be re-created"
+	// MessageDeploymentMigrated is the message used for Events when the temporary
+	// Deployment is deleted
+	MessageDeploymentMigrated = "Deployment %q is available with the new selector, deleted %q"
+)
+
+const (
+	// ServiceRecreated is used as part of the Event 'reason' when a Service
+	// is deleted to be re-created with the clusterIP required by its App
+	ServiceRecreated = "ServiceRecreated"
+
+	// MessageServiceRecreated is the message used for Events when a Service
+	// is deleted because it switched to or from Headless
+	MessageServiceRecreated = "Service %q switched to or from Headless, deleted it to be re-created"
+)